@@ -5,4 +5,9 @@ go 1.21.1
 require (
 	github.com/agonopol/go-stem v0.0.0-20150630113328-985885018250
 	github.com/matryer/way v0.0.0-20180416093233-9632d0c407b0
+	go.etcd.io/bbolt v1.3.8
 )
+
+require golang.org/x/text v0.14.0
+
+require golang.org/x/sys v0.10.0 // indirect
@@ -2,39 +2,170 @@
 package app
 
 import (
+	"errors"
+	"fmt"
 	"github.com/matryer/way"
-	"github.com/mdhender/mbox/internal/stores/newsgroup"
+	"github.com/mdhender/mbox/internal/stores"
+	"io"
+	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type App struct {
-	Host      string
-	NewsGroup *newsgroup.NewsGroup
-	NewSpam   struct {
+	// Admin serves the /admin pages. They are off by default since
+	// anyone who can reach them can reload the archive.
+	Admin bool
+	Host  string
+	// Loader builds a fresh store when the archive is reloaded.
+	// If it is nil, the archive can't be reloaded.
+	Loader  func() (stores.Store, error)
+	NewSpam struct {
 		sync.Mutex
 		AllowReports bool
-		Posts        map[string]*newsgroup.Post
+		Posts        map[string]*stores.Post
 	}
 	Port      string
 	Router    *way.Router
 	Templates string
+
+	store     atomic.Pointer[served]
+	reloading sync.Mutex // held while a reload is running
+}
+
+// served is an archive and the number of requests using it.
+// Once it is replaced by a reload, it is closed when the last one is done.
+type served struct {
+	sync.Mutex
+	store   stores.Store
+	users   int
+	retired bool
 }
 
-func New(ng *newsgroup.NewsGroup, allowSpamReports bool) (*App, error) {
+func New(store stores.Store, allowSpamReports bool) (*App, error) {
 	a := &App{
-		NewsGroup: ng,
 		Port:      "8080",
 		Router:    way.NewRouter(),
 		Templates: "../templates",
 	}
+	a.store.Store(&served{store: store})
 	a.NewSpam.AllowReports = allowSpamReports
-	a.NewSpam.Posts = make(map[string]*newsgroup.Post)
+	a.NewSpam.Posts = make(map[string]*stores.Post)
+	a.Router.HandleFunc("GET", "/admin/errors", a.adminOnly(a.handleAdminErrors))
+	a.Router.HandleFunc("POST", "/admin/reload", a.adminOnly(a.handleAdminReload))
+	a.Router.HandleFunc("GET", "/authors/:address", a.handleAuthor)
 	a.Router.HandleFunc("GET", "/posts", a.handleIndex())
 	a.Router.HandleFunc("GET", "/from/:year", a.handleYear)
 	a.Router.HandleFunc("GET", "/from/:year/:month", a.handleYearMonth)
 	a.Router.HandleFunc("GET", "/from/:year/:month/:day", a.handleYearMonthDay)
 	a.Router.HandleFunc("GET", "/posts/:id", a.handlePosts)
+	a.Router.HandleFunc("GET", "/posts/:id/attachments/:n", a.handlePostAttachment)
+	a.Router.HandleFunc("GET", "/posts/:id/thread", a.handleThread)
 	a.Router.NotFound = a.notFound()
 
 	return a, nil
 }
+
+// Store returns the archive currently being served and a function to call
+// when done with it. Handlers should call it once per request so that they
+// see a single archive even if it is swapped out by a reload. The archive
+// isn't closed until every caller is done with it.
+func (a *App) Store() (stores.Store, func()) {
+	for {
+		s := a.store.Load()
+		s.Lock()
+		if s.retired {
+			// a reload swapped it out after we loaded it
+			s.Unlock()
+			continue
+		}
+		s.users++
+		s.Unlock()
+		return s.store, s.release
+	}
+}
+
+// release marks one user as done and closes a retired archive
+// once nobody is using it.
+func (s *served) release() {
+	s.Lock()
+	s.users--
+	done := s.retired && s.users == 0
+	s.Unlock()
+	if done {
+		s.close()
+	}
+}
+
+// retire closes the archive now if nobody is using it,
+// or else when the last user releases it.
+func (s *served) retire() {
+	s.Lock()
+	s.retired = true
+	done := s.users == 0
+	s.Unlock()
+	if done {
+		s.close()
+	}
+}
+
+func (s *served) close() {
+	if closer, ok := s.store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("[app] reload: %v\n", err)
+		}
+	}
+}
+
+// ErrReloading is returned when a reload is asked for while one is running.
+var ErrReloading = errors.New("reload: already running")
+
+// Reload builds a new archive with the Loader and swaps it in once it is
+// ready. Requests are served from the current archive until then.
+// It returns ErrReloading if a reload is already running.
+func (a *App) Reload() error {
+	if err := a.lockReload(); err != nil {
+		return err
+	}
+	defer a.reloading.Unlock()
+	return a.reload()
+}
+
+// StartReload is Reload run in the background. It returns once the reload
+// has started, or ErrReloading if one is already running.
+func (a *App) StartReload() error {
+	if err := a.lockReload(); err != nil {
+		return err
+	}
+	go func() {
+		defer a.reloading.Unlock()
+		if err := a.reload(); err != nil {
+			log.Printf("[app] %v\n", err)
+		}
+	}()
+	return nil
+}
+
+// lockReload takes the reload lock if the archive can be reloaded.
+func (a *App) lockReload() error {
+	if a.Loader == nil {
+		return fmt.Errorf("reload: no loader")
+	} else if !a.reloading.TryLock() {
+		return ErrReloading
+	}
+	return nil
+}
+
+// reload swaps in a new archive. The caller must hold the reload lock.
+func (a *App) reload() error {
+	started := time.Now()
+	store, err := a.Loader()
+	if err != nil {
+		return fmt.Errorf("reload: %w", err)
+	}
+	// requests that are still using the old archive keep it open
+	a.store.Swap(&served{store: store}).retire()
+	log.Printf("[app] reloaded archive in %v\n", time.Now().Sub(started))
+	return nil
+}
@@ -1,10 +1,18 @@
 package app
 
 import (
+	"errors"
+	"fmt"
 	"github.com/matryer/way"
+	"github.com/mdhender/mbox/internal/query"
+	"github.com/mdhender/mbox/internal/stores"
+	"html/template"
 	"log"
+	"mime"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -15,12 +23,50 @@ type Index struct {
 	Years        []*Period
 }
 
+type SearchPage struct {
+	Search             string
+	Error              string // why the query couldn't be run
+	AllowSpamReporting bool
+	Total              int
+	First              int // number of the first post on the page, counting from 1
+	Last               int // number of the last post on the page
+	Posts              []*SearchHit
+	Suggestion         string // the query with misspelled words corrected, if nothing matched
+	SuggestionUrl      string
+	Prev               string // url of the previous page
+	Next               string // url of the next page
+	Years              []*FacetLink
+	Months             []*FacetLink
+	Authors            []*FacetLink
+	Threads            []*FacetLink
+}
+
+// FacetLink narrows a search to a group of the posts that matched.
+type FacetLink struct {
+	Label string
+	Count int
+	Url   string
+}
+
+type SearchHit struct {
+	ShaId     string
+	Url       string
+	Spam      bool
+	From      string
+	AuthorUrl string
+	Subject   string
+	Date      string
+	Snippet   template.HTML // part of the body with the matched words highlighted
+}
+
 type Post struct {
 	Id           string
 	Url          string
 	Spam         bool
 	Struck       bool
-	From         string
+	From         string // display name of the sender
+	FromAddress  string // normalized address of the sender
+	AuthorUrl    string // url of the posts by the sender
 	Subject      string
 	Date         string
 	Lines        int
@@ -28,6 +74,26 @@ type Post struct {
 	References   []Reference // list of id
 	ReferencedBy []Reference // list of id
 	Parent       string      // url of parent post
+	ThreadUrl    string      // url of the posts in the same thread
+	Attachments  []Attachment
+	Canonical    string      // url of the canonical post if this is a duplicate copy
+	Duplicate    string      // how this copy differs from the canonical post
+	Alternates   []Alternate // other copies of this post
+}
+
+type Alternate struct {
+	Url       string
+	Duplicate string
+	LineNo    int
+	From      string
+	Date      string
+}
+
+type Attachment struct {
+	Name string
+	Type string
+	Size int
+	Url  string
 }
 
 type PostsCollection struct {
@@ -36,6 +102,19 @@ type PostsCollection struct {
 	Posts  []*Post
 }
 
+type QuarantineReport struct {
+	Count int
+	Posts []*QuarantinedPost
+}
+
+type QuarantinedPost struct {
+	LineNo  int
+	Id      string
+	From    string
+	Subject string
+	Errors  []string
+}
+
 type Reference struct {
 	Url     string
 	From    string
@@ -58,37 +137,164 @@ type Bucket struct {
 }
 
 func (a *App) handleIndex() http.HandlerFunc {
-	var payload Index
-	var mind, maxd time.Time
-	for _, post := range a.NewsGroup.Posts.ByShaId {
-		// don't include missing posts
-		if post.Missing {
-			continue
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("q") {
+			a.handleSearch(w, r)
+			return
 		}
-		payload.ArticleCount++
-		if mind.IsZero() || post.Date.Before(mind) {
-			mind = post.Date
+		store, release := a.Store()
+		defer release()
+		stats, err := store.Stats()
+		if err != nil {
+			a.handleError(w, r, err)
+			return
 		}
-		if maxd.IsZero() || post.Date.After(maxd) {
-			maxd = post.Date
+		payload := Index{
+			ArticleCount: stats.Posts,
+			From:         stats.From.Format("January 2, 2006"),
+			Through:      stats.Through.Format("January 2, 2006"),
 		}
+		for _, year := range stats.Years {
+			payload.Years = append(payload.Years, &Period{
+				Name:  year.Name,
+				Count: year.Count,
+				Url:   "/from/" + year.Name,
+			})
+		}
+
+		a.render(w, r, payload, "layout", "index")
 	}
-	payload.From = mind.Format("January 2, 2006")
-	payload.Through = maxd.Format("January 2, 2006")
-	for year, count := range a.NewsGroup.Posts.Years {
-		payload.Years = append(payload.Years, &Period{
-			Name:  year,
-			Count: count,
-			Url:   "/from/" + year,
+}
+
+// searchPageSize is the number of posts on each page of search results.
+const searchPageSize = 20
+
+// handleSearch lists a page of the posts that match the query, best match first.
+func (a *App) handleSearch(w http.ResponseWriter, r *http.Request) {
+	payload := SearchPage{
+		Search:             strings.TrimSpace(r.URL.Query().Get("q")),
+		AllowSpamReporting: a.NewSpam.AllowReports,
+	}
+	if payload.Search == "" {
+		a.render(w, r, payload, "layout", "posts_search")
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	offset := (page - 1) * searchPageSize
+
+	store, release := a.Store()
+	defer release()
+	results, err := store.Search(payload.Search, offset, searchPageSize)
+	var syntaxErr *query.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		payload.Error = fmt.Sprintf("%s (at character %d)", syntaxErr.Msg, syntaxErr.Pos+1)
+		a.render(w, r, payload, "layout", "posts_search")
+		return
+	} else if err != nil {
+		a.handleError(w, r, err)
+		return
+	}
+	log.Printf("[app] search %q: %d posts\n", payload.Search, results.Total)
+	for _, hit := range results.Hits {
+		post, err := store.Post(hit.ShaId)
+		if err != nil {
+			a.handleError(w, r, err)
+			return
+		}
+		payload.Posts = append(payload.Posts, &SearchHit{
+			ShaId:     hit.ShaId,
+			Url:       "/posts/" + hit.ShaId,
+			Spam:      hit.Spam,
+			From:      hit.From,
+			AuthorUrl: authorUrl(&hit.Summary),
+			Subject:   hit.Subject,
+			Date:      hit.Date.Format("2006-01-02 15:04:05"),
+			Snippet:   snippet(post.Body, results.Words),
 		})
 	}
-	sort.Slice(payload.Years, func(i, j int) bool {
-		return payload.Years[i].Name < payload.Years[j].Name
-	})
+	payload.Total = results.Total
+	if results.Suggestion != "" {
+		payload.Suggestion, payload.SuggestionUrl = results.Suggestion, searchUrl(results.Suggestion, 1)
+	}
+	if facets := results.Facets; facets != nil {
+		payload.Years = facetLinks(payload.Search, facets.Years)
+		payload.Months = facetLinks(payload.Search, facets.Months)
+		payload.Authors = facetLinks(payload.Search, facets.Authors)
+		payload.Threads = facetLinks(payload.Search, facets.Threads)
+	}
+	if len(payload.Posts) != 0 {
+		payload.First, payload.Last = offset+1, offset+len(payload.Posts)
+	}
+	if page > 1 {
+		payload.Prev = searchUrl(payload.Search, page-1)
+	}
+	if offset+len(payload.Posts) < results.Total {
+		payload.Next = searchUrl(payload.Search, page+1)
+	}
+	a.render(w, r, payload, "layout", "posts_search")
+}
 
+// adminOnly serves the page only if the admin pages are turned on.
+func (a *App) adminOnly(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		a.render(w, r, payload, "layout", "index")
+		if !a.Admin {
+			a.handleNotFound(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *App) handleAdminErrors(w http.ResponseWriter, r *http.Request) {
+	store, release := a.Store()
+	defer release()
+	quarantine, err := store.Quarantine()
+	if err != nil {
+		a.handleError(w, r, err)
+		return
 	}
+	var payload QuarantineReport
+	for _, post := range quarantine {
+		payload.Posts = append(payload.Posts, &QuarantinedPost{
+			LineNo:  post.LineNo,
+			Id:      post.Id,
+			From:    post.From,
+			Subject: post.Subject,
+			Errors:  post.Errors,
+		})
+	}
+	payload.Count = len(payload.Posts)
+	a.render(w, r, payload, "layout", "admin_errors")
+}
+
+// handleAdminReload starts reloading the archive in the background.
+func (a *App) handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	if a.Loader == nil {
+		http.Error(w, "reload is not enabled", http.StatusNotImplemented)
+		return
+	} else if err := a.StartReload(); errors.Is(err, ErrReloading) {
+		http.Error(w, "reload is already running", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = w.Write([]byte("reload started\n"))
+}
+
+// handleError responds to an error from the store.
+func (a *App) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, stores.ErrNotFound) {
+		log.Printf("[app] %s %s: not found\n", r.Method, r.URL.Path)
+		a.handleNotFound(w, r)
+		return
+	}
+	log.Printf("[app] %s %s: %v\n", r.Method, r.URL.Path, err)
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 }
 
 func (a *App) handleNotFound(w http.ResponseWriter, r *http.Request) {
@@ -107,92 +313,180 @@ func (a *App) handlePosts(w http.ResponseWriter, r *http.Request) {
 	var payload Post
 
 	id := way.Param(r.Context(), "id")
-	post, ok := a.NewsGroup.Posts.ByShaId[id]
-	if !ok {
-		log.Printf("[app] post %q not found\n", id)
-		a.handleNotFound(w, r)
+	store, release := a.Store()
+	defer release()
+	post, err := store.Post(id)
+	if err != nil {
+		a.handleError(w, r, err)
 		return
 	}
 	log.Printf("[app] found post %q by id %q\n", post.Id, id)
 	payload = Post{
-		Id:      post.ShaId,
-		Url:     "/posts/" + post.ShaId,
-		Spam:    post.Spam,
-		Struck:  post.Struck,
-		From:    post.Sender,
-		Subject: post.Subject,
-		Date:    post.Date.Format(time.RFC1123Z),
-		Lines:   post.Lines,
-		Body:    post.Body,
-		Parent:  post.Date.Format("/from/2006/01/02"),
+		Id:          post.ShaId,
+		Url:         "/posts/" + post.ShaId,
+		Spam:        post.Spam,
+		Struck:      post.Struck,
+		From:        post.From,
+		FromAddress: post.FromAddress,
+		AuthorUrl:   authorUrl(&post.Summary),
+		Subject:     post.Subject,
+		Date:        post.Date.Format(time.RFC1123Z),
+		Lines:       post.Lines,
+		Body:        post.Body,
+		Parent:      post.Date.Format("/from/2006/01/02"),
+		ThreadUrl:   "/posts/" + post.ShaId + "/thread",
+	}
+	for n, attachment := range post.Attachments {
+		name := attachment.Name
+		if name == "" {
+			name = fmt.Sprintf("attachment-%d", n+1)
+		}
+		payload.Attachments = append(payload.Attachments, Attachment{
+			Name: name,
+			Type: attachment.Type,
+			Size: attachment.Size,
+			Url:  fmt.Sprintf("/posts/%s/attachments/%d", post.ShaId, n+1),
+		})
+	}
+	if post.DuplicateOf != nil {
+		payload.Canonical, payload.Duplicate = "/posts/"+post.DuplicateOf.ShaId, post.Duplicate
+	}
+	for _, alternate := range post.Alternates {
+		payload.Alternates = append(payload.Alternates, Alternate{
+			Url:       "/posts/" + alternate.ShaId,
+			Duplicate: alternate.Duplicate,
+			LineNo:    alternate.LineNo,
+			From:      alternate.From,
+			Date:      alternate.Date.Format(time.RFC1123Z),
+		})
 	}
 	for _, ref := range post.References {
-		if ref.Subject != "** missing post **" {
-			payload.References = append(payload.References, Reference{
-				Url:     "/posts/" + ref.ShaId,
-				From:    ref.Sender,
-				Subject: ref.Subject,
-				Date:    ref.Date.Format(time.RFC1123Z),
-			})
+		if !ref.Missing {
+			payload.References = append(payload.References, reference(ref))
 		}
 	}
 	for _, ref := range post.ReferencedBy {
-		if ref.Subject != "** missing post **" {
-			payload.ReferencedBy = append(payload.ReferencedBy, Reference{
-				Url:     "/posts/" + ref.ShaId,
-				From:    ref.Sender,
-				Subject: ref.Subject,
-				Date:    ref.Date.Format(time.RFC1123Z),
-			})
+		if !ref.Missing {
+			payload.ReferencedBy = append(payload.ReferencedBy, reference(ref))
 		}
 	}
 
 	a.render(w, r, payload, "layout", "post")
 }
 
-func (a *App) handleYear(w http.ResponseWriter, r *http.Request) {
-	year := way.Param(r.Context(), "year")
-	payload := Bucket{Name: year, Parent: "/posts"}
-	bucket, ok := a.NewsGroup.Posts.ByPeriod[year]
-	if !ok {
-		log.Printf("[app] year %q not found\n", year)
+func (a *App) handlePostAttachment(w http.ResponseWriter, r *http.Request) {
+	id := way.Param(r.Context(), "id")
+	n, err := strconv.Atoi(way.Param(r.Context(), "n"))
+	if err != nil {
+		log.Printf("[app] post %q attachment %q not found\n", id, way.Param(r.Context(), "n"))
 		a.handleNotFound(w, r)
 		return
 	}
-	for _, child := range bucket.SubPeriods {
-		payload.Children = append(payload.Children, &Bucket{
-			Name:  child.Period,
-			Url:   "/from/" + child.Period,
-			Count: child.Count(),
+	store, release := a.Store()
+	defer release()
+	attachment, err := store.Attachment(id, n)
+	if err != nil {
+		a.handleError(w, r, err)
+		return
+	}
+	contentType := attachment.Type
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Data)))
+	if attachment.Name != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	} else {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	// never let the browser sniff an attachment into something executable
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(attachment.Data)
+}
+
+// handleThread lists the posts linked to a post.
+func (a *App) handleThread(w http.ResponseWriter, r *http.Request) {
+	id := way.Param(r.Context(), "id")
+	store, release := a.Store()
+	defer release()
+	posts, err := store.Thread(id)
+	if err != nil {
+		a.handleError(w, r, err)
+		return
+	}
+	payload := PostsCollection{
+		Name:   "Thread",
+		Parent: "/posts/" + id,
+	}
+	if len(posts) != 0 {
+		payload.Name = "Thread: " + posts[0].Subject
+	}
+	for _, post := range posts {
+		payload.Posts = append(payload.Posts, &Post{
+			Url:     "/posts/" + post.ShaId,
+			From:    post.From,
+			Subject: post.Subject,
+			Date:    post.Date.Format("2006-01-02 15:04:05"),
 		})
 	}
-	sort.Slice(payload.Children, func(i, j int) bool {
-		return payload.Children[i].Name < payload.Children[j].Name
-	})
-	a.render(w, r, payload, "layout", "from_yyyy")
+	a.render(w, r, payload, "layout", "thread")
+}
+
+// handleAuthor lists the posts from a single sender.
+func (a *App) handleAuthor(w http.ResponseWriter, r *http.Request) {
+	address := strings.ToLower(way.Param(r.Context(), "address"))
+	store, release := a.Store()
+	defer release()
+	posts, err := store.Author(address)
+	if err != nil {
+		a.handleError(w, r, err)
+		return
+	}
+	payload := PostsCollection{
+		Name:   address,
+		Parent: "/posts",
+	}
+	for _, post := range posts {
+		payload.Posts = append(payload.Posts, &Post{
+			Url:     "/posts/" + post.ShaId,
+			From:    post.From,
+			Subject: post.Subject,
+			Date:    post.Date.Format("2006-01-02 15:04:05"),
+		})
+	}
+	a.render(w, r, payload, "layout", "from_yyyy_mm_dd")
+}
+
+func (a *App) handleYear(w http.ResponseWriter, r *http.Request) {
+	year := way.Param(r.Context(), "year")
+	a.renderPeriod(w, r, year, "/posts", "from_yyyy")
 }
 
 func (a *App) handleYearMonth(w http.ResponseWriter, r *http.Request) {
 	year := way.Param(r.Context(), "year")
 	month := way.Param(r.Context(), "month")
-	payload := Bucket{Name: year + "/" + month, Parent: "/from/" + year}
-	bucket, ok := a.NewsGroup.Posts.ByPeriod[payload.Name]
-	if !ok {
-		log.Printf("[app] year %q month %q not found\n", year, month)
-		a.handleNotFound(w, r)
+	a.renderPeriod(w, r, year+"/"+month, "/from/"+year, "from_yyyy_mm")
+}
+
+// renderPeriod renders the sub-periods of a year or month.
+func (a *App) renderPeriod(w http.ResponseWriter, r *http.Request, name, parent, template string) {
+	store, release := a.Store()
+	defer release()
+	period, err := store.Period(name)
+	if err != nil {
+		a.handleError(w, r, err)
 		return
 	}
-	for _, child := range bucket.SubPeriods {
+	payload := Bucket{Name: name, Parent: parent}
+	for _, child := range period.Children {
 		payload.Children = append(payload.Children, &Bucket{
-			Name:  child.Period,
-			Url:   "/from/" + child.Period,
-			Count: child.Count(),
+			Name:  child.Name,
+			Url:   "/from/" + child.Name,
+			Count: child.Count,
 		})
 	}
-	sort.Slice(payload.Children, func(i, j int) bool {
-		return payload.Children[i].Name < payload.Children[j].Name
-	})
-	a.render(w, r, payload, "layout", "from_yyyy_mm")
+	a.render(w, r, payload, "layout", template)
 }
 
 func (a *App) handleYearMonthDay(w http.ResponseWriter, r *http.Request) {
@@ -203,16 +497,17 @@ func (a *App) handleYearMonthDay(w http.ResponseWriter, r *http.Request) {
 		Name:   year + "/" + month + "/" + day,
 		Parent: "/from/" + year + "/" + month,
 	}
-	bucket, ok := a.NewsGroup.Posts.ByPeriod[payload.Name]
-	if !ok {
-		log.Printf("[app] year %q month %q day %q not found\n", year, month, day)
-		a.handleNotFound(w, r)
+	store, release := a.Store()
+	defer release()
+	period, err := store.Period(payload.Name)
+	if err != nil {
+		a.handleError(w, r, err)
 		return
 	}
-	for _, post := range bucket.Posts {
+	for _, post := range period.Posts {
 		payload.Posts = append(payload.Posts, &Post{
 			Url:     "/posts/" + post.ShaId,
-			From:    post.Sender,
+			From:    post.From,
 			Subject: post.Subject,
 			Date:    post.Date.Format("15:04:05"),
 		})
@@ -220,6 +515,46 @@ func (a *App) handleYearMonthDay(w http.ResponseWriter, r *http.Request) {
 	a.render(w, r, payload, "layout", "from_yyyy_mm_dd")
 }
 
+// authorUrl returns the url for the posts by the sender of a post.
+func authorUrl(post *stores.Summary) string {
+	if post.Author != "" {
+		return "/authors/" + url.PathEscape(post.Author)
+	}
+	return ""
+}
+
+// searchUrl returns the url for a page of search results.
+func searchUrl(search string, page int) string {
+	values := url.Values{"q": {search}}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	return "/posts?" + values.Encode()
+}
+
+// facetLinks returns the links that narrow a search to each facet.
+// A single facet isn't worth showing since it wouldn't narrow anything.
+func facetLinks(search string, facets []*stores.Facet) []*FacetLink {
+	if len(facets) < 2 {
+		return nil
+	}
+	var links []*FacetLink
+	for _, f := range facets {
+		links = append(links, &FacetLink{Label: f.Label, Count: f.Count, Url: searchUrl(query.Narrow(search, f.Query), 1)})
+	}
+	return links
+}
+
+// reference returns the link to another post.
+func reference(post *stores.Summary) Reference {
+	return Reference{
+		Url:     "/posts/" + post.ShaId,
+		From:    post.From,
+		Subject: post.Subject,
+		Date:    post.Date.Format(time.RFC1123Z),
+	}
+}
+
 func (a *App) notFound() http.HandlerFunc {
 	return a.handleNotFound
 }
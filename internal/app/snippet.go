@@ -0,0 +1,72 @@
+package app
+
+import (
+	"github.com/mdhender/mbox/internal/chunk"
+	"html/template"
+	"regexp"
+	"strings"
+)
+
+// snippetWords is the number of words shown in a snippet, not counting
+// short words.
+const snippetWords = 30
+
+var whitespace = regexp.MustCompile(`\s+`)
+
+// snippet returns the part of the body with the most of the stemmed
+// words, with the words highlighted. The body is shown as it was
+// written, so "Playing" is highlighted for "plai".
+func snippet(body string, words []string) template.HTML {
+	match := make(map[string]bool)
+	for _, word := range words {
+		match[word] = true
+	}
+	tokens := chunk.Tokens([]byte(body), nil)
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	// start a little before the match so that it has some context
+	start, best := 0, 0
+	for i, token := range tokens {
+		if !match[string(token.Word)] {
+			continue
+		}
+		from := max(0, i-snippetWords/4)
+		found := make(map[string]bool)
+		for _, t := range tokens[from:min(from+snippetWords, len(tokens))] {
+			if match[string(t.Word)] {
+				found[string(t.Word)] = true
+			}
+		}
+		if len(found) > best {
+			start, best = from, len(found)
+		}
+	}
+	end := min(start+snippetWords, len(tokens))
+
+	sb := &strings.Builder{}
+	if strings.TrimSpace(body[:tokens[start].Start]) != "" {
+		sb.WriteString("… ")
+	}
+	for i, token := range tokens[start:end] {
+		if i != 0 {
+			sb.WriteString(escape(body[tokens[start+i-1].End:token.Start]))
+		}
+		if word := escape(body[token.Start:token.End]); match[string(token.Word)] {
+			sb.WriteString("<mark>" + word + "</mark>")
+		} else {
+			sb.WriteString(word)
+		}
+	}
+	if strings.TrimSpace(body[tokens[end-1].End:]) != "" {
+		sb.WriteString(" …")
+	}
+	return template.HTML(sb.String())
+}
+
+// escape escapes text for HTML, folding line breaks and runs of spaces
+// into a single space.
+func escape(text string) string {
+	return template.HTMLEscapeString(whitespace.ReplaceAllString(text, " "))
+}
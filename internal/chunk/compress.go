@@ -0,0 +1,53 @@
+package chunk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+)
+
+// bufferSize is the size of the buffer used to read input.
+const bufferSize = 64 * 1024
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// decompress checks the start of the input for the magic bytes of a
+// gzip or bzip2 stream. If it finds one, it returns a reader that
+// decompresses the input on the fly. Otherwise, it returns br as is.
+func decompress(br *bufio.Reader) (*bufio.Reader, error) {
+	magic, err := br.Peek(3)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.HasPrefix(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return bufio.NewReaderSize(zr, bufferSize), nil
+	} else if bytes.HasPrefix(magic, bzip2Magic) {
+		return bufio.NewReaderSize(bzip2.NewReader(br), bufferSize), nil
+	}
+	return br, nil
+}
+
+// Compressed reports whether the file at path is compressed with gzip or bzip2.
+func Compressed(path string) (bool, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fd.Close()
+	magic := make([]byte, 3)
+	n, err := io.ReadFull(fd, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return bytes.HasPrefix(magic[:n], gzipMagic) || bytes.HasPrefix(magic[:n], bzip2Magic), nil
+}
@@ -0,0 +1,250 @@
+package chunk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dir is a Source that reads one message per file from a tree of
+// Maildir and MH folders.
+//
+// Maildir flags from the file name are added to the header as
+// "X-Maildir-Flags" and MH sequences are added as "X-MH-Sequences,"
+// so they end up in the Keys of the post.
+type Dir struct {
+	root     string
+	messages []*dirMessage
+	next     int
+}
+
+type dirMessage struct {
+	path   string // path of the message file
+	header string // extra header line, may be empty
+}
+
+// OpenDir walks the tree at root and returns a Source for every
+// Maildir and MH message in it. Maildir folders are directories with
+// "cur" and "new" subdirectories; MH messages are files with numeric names.
+func OpenDir(root string) (*Dir, error) {
+	d := &Dir{root: root}
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if !entry.IsDir() {
+			return nil
+		} else if entry.Name() == "tmp" && isMaildir(filepath.Dir(path)) {
+			// messages in tmp are still being delivered
+			return fs.SkipDir
+		} else if (entry.Name() == "cur" || entry.Name() == "new") && isMaildir(filepath.Dir(path)) {
+			// added when the parent was visited
+			return nil
+		}
+		if isMaildir(path) {
+			return d.addMaildir(path)
+		}
+		return d.addMH(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Next returns the next message in the tree.
+func (d *Dir) Next() (*Chunk, error) {
+	if d.next >= len(d.messages) {
+		return nil, io.EOF
+	}
+	msg := d.messages[d.next]
+	d.next++
+
+	fd, err := os.Open(msg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	name, err := filepath.Rel(d.root, msg.path)
+	if err != nil {
+		name = msg.path
+	}
+	ch, err := readMessage(fd, []byte("From "+filepath.ToSlash(name)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", msg.path, err)
+	}
+	ch.Line = d.next
+	if msg.header != "" {
+		ch.Header = append(ch.Header, []byte(msg.header))
+	}
+	return ch, nil
+}
+
+// Close does nothing; message files are closed as soon as they are read.
+func (d *Dir) Close() error {
+	return nil
+}
+
+// addMaildir adds the messages in the new and cur folders.
+// Messages are sorted by name, which starts with the delivery time.
+func (d *Dir) addMaildir(path string) error {
+	var messages []*dirMessage
+	for _, folder := range []string{"new", "cur"} {
+		entries, err := os.ReadDir(filepath.Join(path, folder))
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			msg := &dirMessage{path: filepath.Join(path, folder, entry.Name())}
+			// the info section of the name is ":2," followed by the flags
+			if _, flags, ok := strings.Cut(entry.Name(), ":2,"); ok && flags != "" {
+				msg.header = "X-Maildir-Flags: " + flags
+			}
+			messages = append(messages, msg)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return filepath.Base(messages[i].path) < filepath.Base(messages[j].path)
+	})
+	d.messages = append(d.messages, messages...)
+	return nil
+}
+
+// addMH adds the numbered messages in an MH folder along with the
+// sequences listed in the folder's .mh_sequences file.
+func (d *Dir) addMH(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	var numbers []int
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		} else if n, err := strconv.Atoi(entry.Name()); err == nil && n > 0 {
+			numbers = append(numbers, n)
+		}
+	}
+	if len(numbers) == 0 {
+		return nil
+	}
+	sort.Ints(numbers)
+
+	sequences, err := readSequences(filepath.Join(path, ".mh_sequences"))
+	if err != nil {
+		return err
+	}
+	for _, n := range numbers {
+		msg := &dirMessage{path: filepath.Join(path, strconv.Itoa(n))}
+		var names []string
+		for _, seq := range sequences {
+			if seq.from <= n && n <= seq.thru {
+				names = append(names, seq.name)
+			}
+		}
+		if len(names) != 0 {
+			msg.header = "X-MH-Sequences: " + strings.Join(names, " ")
+		}
+		d.messages = append(d.messages, msg)
+	}
+	return nil
+}
+
+func isMaildir(path string) bool {
+	for _, folder := range []string{"cur", "new"} {
+		if sb, err := os.Stat(filepath.Join(path, folder)); err != nil || !sb.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// sequence is a range of message numbers in an MH sequence.
+type sequence struct {
+	name       string
+	from, thru int
+}
+
+// readSequences returns the ranges of message numbers in each sequence.
+// Lines in the file look like "unseen: 1-3 7 9". The ranges are kept as
+// they are rather than expanded, since a corrupt file can list billions
+// of numbers. A missing file is not an error.
+func readSequences(path string) ([]sequence, error) {
+	var sequences []sequence
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, list, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		for _, field := range strings.Fields(list) {
+			lo, hi, isRange := strings.Cut(field, "-")
+			from, err := strconv.Atoi(lo)
+			if err != nil {
+				continue
+			}
+			thru := from
+			if isRange {
+				if thru, err = strconv.Atoi(hi); err != nil {
+					continue
+				}
+			}
+			if from <= thru {
+				sequences = append(sequences, sequence{name: strings.TrimSpace(name), from: from, thru: thru})
+			}
+		}
+	}
+	return sequences, nil
+}
+
+// readMessage splits a single message into a chunk.
+// If the message doesn't start with a "From " line, from is used instead.
+// Compressed message files are decompressed.
+func readMessage(r io.Reader, from []byte) (*Chunk, error) {
+	br, err := decompress(bufio.NewReaderSize(r, bufferSize))
+	if err != nil {
+		return nil, err
+	}
+	var lines [][]byte
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) != 0 {
+			lines = append(lines, bytes.TrimRight(line, " \r\t\n"))
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	ch := &Chunk{From: from}
+	if len(lines) != 0 && bytes.HasPrefix(lines[0], []byte("From ")) {
+		ch.From, lines = lines[0], lines[1:]
+	}
+	for len(lines) != 0 {
+		line := lines[0]
+		lines = lines[1:]
+		if len(line) == 0 {
+			break
+		}
+		ch.addHeader(line)
+	}
+	ch.Body = lines
+	return ch, nil
+}
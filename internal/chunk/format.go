@@ -0,0 +1,194 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Format detects message boundaries for one variant of the mbox format.
+type Format interface {
+	// Name returns the name of the variant.
+	Name() string
+	// IsStart reports whether line is the "From " line that starts a message.
+	IsStart(line []byte) bool
+	// IsEnd reports whether the body of the current message ends before
+	// the look-ahead lines. The look-ahead holds up to three lines and
+	// is empty at the end of the input. length is the Content-Length of
+	// the message (or -1 if it doesn't have one) and read is the number
+	// of body bytes consumed so far.
+	IsEnd(lookAhead [][]byte, length, read int) bool
+	// Unescape removes any "From " quoting from a body line.
+	Unescape(line []byte) []byte
+}
+
+var (
+	// Takeout is the format of the Google Takeout archives.
+	// Messages start with "From" and a numeric ID and are separated by two blank lines.
+	Takeout Format = &takeout{som: regexp.MustCompile("^From -?[0-9]+$")}
+	// Mboxo separates messages with a blank line and a "From " line.
+	// Body lines starting with "From " were quoted as ">From ".
+	Mboxo Format = &mbox{name: "mboxo", quoting: regexp.MustCompile("^>From ")}
+	// Mboxrd is mboxo with reversible quoting: any number of ">" before "From " is quoted.
+	Mboxrd Format = &mbox{name: "mboxrd", quoting: regexp.MustCompile("^>+From ")}
+	// Mboxcl uses the Content-Length header to find the end of the body and quotes like mboxo.
+	Mboxcl Format = &mbox{name: "mboxcl", quoting: regexp.MustCompile("^>From "), contentLength: true}
+	// Mboxcl2 uses the Content-Length header to find the end of the body and doesn't quote.
+	Mboxcl2 Format = &mbox{name: "mboxcl2", contentLength: true}
+)
+
+// Formats is the list of formats that can be selected by name.
+var Formats = []Format{Takeout, Mboxo, Mboxrd, Mboxcl, Mboxcl2}
+
+// FormatByName returns the format with the given name.
+// It returns nil for "auto," which tells the Reader to detect the format.
+func FormatByName(name string) (Format, error) {
+	if name == "" || name == "auto" {
+		return nil, nil
+	}
+	for _, f := range Formats {
+		if f.Name() == name {
+			return f, nil
+		}
+	}
+	var names []string
+	for _, f := range Formats {
+		names = append(names, f.Name())
+	}
+	return nil, fmt.Errorf("unknown format %q: want auto or one of %s", name, strings.Join(names, ", "))
+}
+
+type takeout struct {
+	som *regexp.Regexp
+}
+
+func (f *takeout) Name() string {
+	return "takeout"
+}
+
+func (f *takeout) IsStart(line []byte) bool {
+	return f.som.Find(line) != nil
+}
+
+func (f *takeout) IsEnd(lookAhead [][]byte, length, read int) bool {
+	return endOfMessage(lookAhead)
+}
+
+func (f *takeout) Unescape(line []byte) []byte {
+	return line
+}
+
+type mbox struct {
+	name          string
+	quoting       *regexp.Regexp // nil if the variant doesn't quote "From " lines
+	contentLength bool           // true if Content-Length marks the end of the body
+}
+
+// fromLine matches the "From sender date" line that starts a message.
+// The date is required so that an unquoted "From " in a body isn't
+// mistaken for a new message.
+var fromLine = regexp.MustCompile(`^From \S+ .*[0-9]{1,2}:[0-9]{2}`)
+
+func (f *mbox) Name() string {
+	return f.name
+}
+
+func (f *mbox) IsStart(line []byte) bool {
+	return fromLine.Find(line) != nil
+}
+
+func (f *mbox) IsEnd(lookAhead [][]byte, length, read int) bool {
+	if len(lookAhead) == 0 {
+		return true
+	} else if f.contentLength && length >= 0 {
+		return read >= length
+	} else if len(lookAhead) == 1 && len(lookAhead[0]) == 0 {
+		// the blank line at the end of the input separates nothing
+		return true
+	}
+	return len(lookAhead) > 1 && len(lookAhead[0]) == 0 && f.IsStart(lookAhead[1])
+}
+
+func (f *mbox) Unescape(line []byte) []byte {
+	if f.quoting != nil && f.quoting.Find(line) != nil {
+		return line[1:]
+	}
+	return line
+}
+
+// contentLength returns the value of the Content-Length header, or -1 if
+// the header is missing or invalid.
+func contentLength(header [][]byte) int {
+	for _, line := range header {
+		key, value, found := bytes.Cut(line, []byte{':'})
+		if !found || !bytes.EqualFold(key, []byte("Content-Length")) {
+			continue
+		}
+		n, err := strconv.Atoi(string(bytes.TrimSpace(value)))
+		if err != nil || n < 0 {
+			return -1
+		}
+		return n
+	}
+	return -1
+}
+
+// detectFormat guesses the format from the first message in the input.
+// sizes holds the size of each line and eof is true if lines runs to the
+// end of the input. Takeout archives are recognized by their numeric
+// "From " line. A Content-Length header selects mboxcl2 only if the body
+// it describes ends exactly where the next message starts, since mail
+// clients often leave stale lengths in mboxo files. Anything else is read
+// as mboxrd, which also reads mboxo files correctly unless they contain
+// ">>From ".
+func detectFormat(lines [][]byte, sizes []int, eof bool) Format {
+	for n, line := range lines {
+		if !bytes.HasPrefix(line, []byte("From ")) {
+			continue
+		} else if Takeout.IsStart(line) {
+			return Takeout
+		}
+		var header [][]byte
+		body := n + 1
+		for ; body < len(lines) && len(lines[body]) != 0; body++ {
+			header = append(header, lines[body])
+		}
+		// skip the blank line after the header
+		if body++; body > len(lines) {
+			return Mboxrd
+		}
+		if length := contentLength(header); length >= 0 && endsAt(lines[body:], sizes[body:], length, eof) {
+			return Mboxcl2
+		}
+		return Mboxrd
+	}
+	return Mboxrd
+}
+
+// endsAt reports whether a body of length bytes ends on a line boundary
+// that is followed by a blank line and a "From " line, or by nothing but
+// blank lines to the end of the input. It returns false if the body runs
+// past the look-ahead.
+func endsAt(lines [][]byte, sizes []int, length int, eof bool) bool {
+	n, read := 0, 0
+	for ; n < len(lines) && read < length; n++ {
+		read += sizes[n]
+	}
+	if read != length {
+		return false
+	}
+	rest := lines[n:]
+	if len(rest) > 1 && len(rest[0]) == 0 && fromLine.Find(rest[1]) != nil {
+		return true
+	} else if !eof {
+		return false
+	}
+	for _, line := range rest {
+		if len(line) != 0 {
+			return false
+		}
+	}
+	return true
+}
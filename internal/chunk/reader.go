@@ -0,0 +1,152 @@
+package chunk
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// detectLines is the number of lines read ahead to detect the format.
+const detectLines = 200
+
+// Reader splits an mbox stream into chunks one message at a time.
+// Only a small look-ahead buffer is held in memory, so the size of
+// the archive doesn't matter.
+type Reader struct {
+	r      *bufio.Reader
+	opened bool     // true once the input has been checked for compression
+	format Format   // nil until the format has been detected
+	lineNo int      // number of lines consumed
+	offset int64    // number of bytes consumed
+	size   int      // size of the last line consumed, including the newline
+	peeked [][]byte // look-ahead buffer
+	sizes  []int    // size of each line in the look-ahead buffer
+	eof    bool     // true once the final line has been read
+}
+
+// NewReader returns a Reader that pulls chunks from r.
+// If format is nil, the format is detected from the first message.
+// Input compressed with gzip or bzip2 is decompressed on the fly.
+func NewReader(r io.Reader, format Format) *Reader {
+	return &Reader{
+		r:      bufio.NewReaderSize(r, bufferSize),
+		format: format,
+	}
+}
+
+// Format returns the format of the input.
+// It is nil until the first call to Next when the format is being detected.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Next returns the next chunk from the input.
+// It returns io.EOF when there are no more messages.
+func (r *Reader) Next() (*Chunk, error) {
+	if r.format == nil {
+		lookAhead, err := r.peek(detectLines)
+		if err != nil {
+			return nil, err
+		}
+		r.format = detectFormat(lookAhead, r.sizes, r.eof)
+	}
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !r.format.IsStart(line) {
+			continue
+		}
+
+		ch := &Chunk{
+			Line:   r.lineNo,
+			From:   line,
+			Offset: r.offset - int64(r.size),
+		}
+		for {
+			line, err = r.readLine()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			} else if len(line) == 0 {
+				break
+			} else if len(line) == 1 && (line[0] == ' ' || line[0] == '\t') {
+				break
+			}
+			ch.addHeader(line)
+		}
+		length, read := contentLength(ch.Header), 0
+		for {
+			lookAhead, err := r.peek(3)
+			if err != nil {
+				return nil, err
+			} else if r.format.IsEnd(lookAhead, length, read) {
+				break
+			}
+			line, err = r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			read += r.size
+			ch.Body = append(ch.Body, r.format.Unescape(line))
+		}
+		ch.Length, ch.Lines = r.offset-ch.Offset, r.lineNo-ch.Line+1
+		return ch, nil
+	}
+}
+
+// readLine returns the next line with any trailing spaces trimmed.
+// The final line of the input is returned even if it is empty,
+// which matches splitting the entire input on newlines.
+func (r *Reader) readLine() ([]byte, error) {
+	if len(r.peeked) == 0 {
+		if err := r.fill(1); err != nil {
+			return nil, err
+		} else if len(r.peeked) == 0 {
+			return nil, io.EOF
+		}
+	}
+	line := r.peeked[0]
+	r.peeked[0] = nil
+	r.peeked, r.size = r.peeked[1:], r.sizes[0]
+	r.sizes = r.sizes[1:]
+	r.lineNo++
+	r.offset += int64(r.size)
+	return line, nil
+}
+
+// peek returns up to n lines without consuming them.
+// It returns fewer than n lines only at the end of the input.
+func (r *Reader) peek(n int) ([][]byte, error) {
+	if err := r.fill(n); err != nil {
+		return nil, err
+	}
+	if len(r.peeked) < n {
+		return r.peeked, nil
+	}
+	return r.peeked[:n], nil
+}
+
+// fill reads from the input until the look-ahead buffer holds n lines.
+func (r *Reader) fill(n int) error {
+	if !r.opened {
+		br, err := decompress(r.r)
+		if err != nil {
+			return err
+		}
+		r.r, r.opened = br, true
+	}
+	for len(r.peeked) < n && !r.eof {
+		line, err := r.r.ReadBytes('\n')
+		if err == io.EOF {
+			r.eof = true
+		} else if err != nil {
+			return err
+		}
+		r.peeked = append(r.peeked, bytes.TrimRight(line, " \r\t\n"))
+		r.sizes = append(r.sizes, len(line))
+	}
+	return nil
+}
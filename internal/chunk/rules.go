@@ -0,0 +1,155 @@
+package chunk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Rule rewrites the value of a header that we know is broken.
+// A rule either matches the entire value exactly or matches a regular
+// expression. It can be limited to a single message by line number or
+// by Message-ID.
+type Rule struct {
+	Name      string `json:"name,omitempty"`       // label for the report
+	Header    string `json:"header"`               // name of the header, case-insensitive
+	Match     string `json:"match,omitempty"`      // exact value to replace
+	Regex     string `json:"regex,omitempty"`      // regular expression to replace
+	Replace   string `json:"replace"`              // new value, may use $1 etc. with Regex
+	Line      int    `json:"line,omitempty"`       // if set, only the message starting on this line
+	MessageId string `json:"message-id,omitempty"` // if set, only the message with this id
+
+	re    *regexp.Regexp
+	fired atomic.Int64
+}
+
+// Rules is an ordered list of rewrite rules.
+// The first rule that matches a header line is the only one applied.
+type Rules struct {
+	Path  string
+	Rules []*Rule
+}
+
+// LoadRules reads a JSON list of rules from a file.
+func LoadRules(path string) (*Rules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rs := &Rules{Path: path}
+	if err := json.Unmarshal(data, &rs.Rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for n, rule := range rs.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", n+1)
+		}
+		if rule.Header == "" {
+			return nil, fmt.Errorf("%s: %s: missing header", path, rule.Name)
+		} else if (rule.Match == "") == (rule.Regex == "") {
+			return nil, fmt.Errorf("%s: %s: need one of match or regex", path, rule.Name)
+		}
+		if rule.Regex != "" {
+			if rule.re, err = regexp.Compile(rule.Regex); err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", path, rule.Name, err)
+			}
+		}
+		rule.MessageId = strings.Trim(rule.MessageId, "<>")
+	}
+	return rs, nil
+}
+
+// Apply rewrites the header lines of a chunk.
+func (rs *Rules) Apply(ch *Chunk) {
+	if rs == nil || len(rs.Rules) == 0 {
+		return
+	}
+	var messageId string
+	for _, line := range ch.Header {
+		if key, value, ok := bytes.Cut(line, []byte{':'}); ok && bytes.EqualFold(key, []byte("Message-ID")) {
+			messageId = strings.Trim(string(bytes.TrimSpace(value)), "<>")
+			break
+		}
+	}
+	for i, line := range ch.Header {
+		key, value, ok := bytes.Cut(line, []byte{':'})
+		if !ok {
+			continue
+		}
+		value = bytes.TrimSpace(value)
+		for _, rule := range rs.Rules {
+			if !strings.EqualFold(rule.Header, string(key)) {
+				continue
+			} else if rule.Line != 0 && rule.Line != ch.Line {
+				continue
+			} else if rule.MessageId != "" && rule.MessageId != messageId {
+				continue
+			}
+			var replacement []byte
+			if rule.re != nil {
+				if !rule.re.Match(value) {
+					continue
+				}
+				replacement = rule.re.ReplaceAll(value, []byte(rule.Replace))
+			} else if string(value) == rule.Match {
+				replacement = []byte(rule.Replace)
+			} else {
+				continue
+			}
+			rewritten := make([]byte, 0, len(key)+2+len(replacement))
+			rewritten = append(append(rewritten, key...), ':', ' ')
+			ch.Header[i] = append(rewritten, replacement...)
+			rule.fired.Add(1)
+			break
+		}
+	}
+}
+
+// Hash returns a hash of the rules, so that archives parsed with
+// different rules can be told apart. It is empty if there are no rules.
+func (rs *Rules) Hash() string {
+	if rs == nil || len(rs.Rules) == 0 {
+		return ""
+	}
+	// rules only hold strings and numbers, so they always marshal
+	data, _ := json.Marshal(rs.Rules)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Report returns a line for every rule with the number of times it fired.
+func (rs *Rules) Report() []string {
+	if rs == nil {
+		return nil
+	}
+	var lines []string
+	for _, rule := range rs.Rules {
+		lines = append(lines, fmt.Sprintf("%s: %s: fired %d times", rs.Path, rule.Name, rule.fired.Load()))
+	}
+	return lines
+}
+
+// WithRules returns a Source that applies the rules to every chunk from src.
+func WithRules(src Source, rs *Rules) Source {
+	return &rewriter{Source: src, rules: rs}
+}
+
+type rewriter struct {
+	Source
+	rules *Rules
+}
+
+func (r *rewriter) Next() (*Chunk, error) {
+	ch, err := r.Source.Next()
+	if err != nil {
+		return nil, err
+	}
+	r.rules.Apply(ch)
+	return ch, nil
+}
@@ -0,0 +1,78 @@
+package chunk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Source yields chunks one message at a time.
+type Source interface {
+	// Next returns the next chunk.
+	// It returns io.EOF when there are no more messages.
+	Next() (*Chunk, error)
+	// Close releases any resources held by the source.
+	Close() error
+}
+
+// Open returns a Source for the archive at path.
+// A directory is read as a Maildir or MH folder tree.
+// Anything else is read as an mbox file in the given format.
+func Open(path string, format Format) (Source, error) {
+	sb, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if sb.IsDir() {
+		return OpenDir(path)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &file{Reader: NewReader(fd, format), fd: fd}, nil
+}
+
+// OpenAt returns a Source for the messages in an mbox file that start
+// at or after offset. line is the number of lines before offset, so that
+// line numbers match those from reading the entire file. The format must
+// be given since the start of the file isn't read.
+//
+// Offsets are only meaningful for uncompressed files, so OpenAt returns
+// an error if the file is compressed.
+func OpenAt(path string, format Format, offset int64, line int) (Source, error) {
+	if format == nil {
+		return nil, fmt.Errorf("%s: format must be known to read from an offset", path)
+	}
+	if compressed, err := Compressed(path); err != nil {
+		return nil, err
+	} else if compressed {
+		return nil, fmt.Errorf("%s: can't read a compressed file from an offset", path)
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	r := &Reader{
+		r:      bufio.NewReaderSize(fd, bufferSize),
+		opened: true,
+		format: format,
+		lineNo: line,
+		offset: offset,
+	}
+	return &file{Reader: r, fd: fd}, nil
+}
+
+// file is an mbox file that is closed along with the source.
+type file struct {
+	*Reader
+	fd *os.File
+}
+
+func (f *file) Close() error {
+	return f.fd.Close()
+}
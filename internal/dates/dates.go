@@ -0,0 +1,214 @@
+// Package dates parses the dates found in mail and Usenet headers.
+//
+// Real archives are full of dates that don't follow RFC 5322, so Parse
+// tries a series of strategies, from strict to forgiving, and reports
+// which one worked.
+package dates
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Strategy names the method used to find the date of a post.
+type Strategy string
+
+const (
+	RFC5322   Strategy = "rfc5322"           // net/mail accepted the Date header
+	Layout    Strategy = "layout"            // one of the legacy layouts matched the Date header
+	Heuristic Strategy = "heuristic"         // the Date header matched after cleaning it up
+	Received  Strategy = "received"          // taken from a Received header
+	Posted    Strategy = "nntp-posting-date" // taken from the NNTP-Posting-Date header
+	Neighbour Strategy = "neighbour"         // copied from the previous message
+)
+
+// Parse returns the time from a Date header along with the strategy
+// that parsed it. Times are returned in UTC.
+func Parse(value string) (time.Time, Strategy, error) {
+	value = strings.TrimSpace(value)
+	if t, err := mail.ParseDate(value); err == nil {
+		return fixZone(t).UTC(), RFC5322, nil
+	}
+	if t, ok := parseLayouts(value); ok {
+		return fixZone(t).UTC(), Layout, nil
+	}
+	if cleaned := clean(value); cleaned != value {
+		if t, err := mail.ParseDate(cleaned); err == nil {
+			return fixZone(t).UTC(), Heuristic, nil
+		} else if t, ok := parseLayouts(cleaned); ok {
+			return fixZone(t).UTC(), Heuristic, nil
+		}
+	}
+	return time.Time{}, "", fmt.Errorf("unknown layout %q", value)
+}
+
+// ParseReceived returns the time from a Received header.
+// The date follows the last semicolon in the header.
+func ParseReceived(value string) (time.Time, error) {
+	i := strings.LastIndexByte(value, ';')
+	if i == -1 {
+		return time.Time{}, fmt.Errorf("received: missing date")
+	}
+	t, _, err := Parse(value[i+1:])
+	return t, err
+}
+
+// layouts are the formats seen in the archives that net/mail rejects.
+var layouts = []string{
+	//	"Thu, 24 Mar 2011 20:09:09 -0700 (PDT)"
+	"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
+	// "09 Oct 2007 02:46:48 GMT"
+	"02 Jan 2006 15:04:05 MST",
+	// "10 May 2011 12:36:45 GMT"
+	"2 Jan 2006 15:04:05 MST",
+	// "02 Aug 2003 00:26:31 +0200"
+	"02 Jan 2006 15:04:05 -0700",
+	// "10 May 2011 08:53:15 -0400"
+	"2 Jan 2006 15:04:05 -0700",
+	// "Mon, 05 Jan 2009 13:44:02 -0600"
+	"Mon, 02 Jan 2006 15:04:05 -0700",
+	// "Tue, 4 Sep 2012 20:37:24 +0200"
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	// "Wed, 7 Jan 2009 07:26:42 GMT"
+	"Mon, 02 Jan 2006 15:04:05 MST",
+	// "Sun, 28 Dec 2008 22:43:09 GMT"
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	// "15 Feb 01 17:44:09 GMT"
+	"2 Jan 06 15:04:05 MST",
+	// "Sat, 17 Feb 01 23:14:55"
+	"Mon, 2 Jan 06 15:04:05",
+	// "15 Dec 00 15:28:22 +0100"
+	"2 Jan 06 15:04:05 -0700",
+	// "2000/11/28"
+	"2006/01/02",
+	// "25 Mar 95 19:26:17"
+	"2 Jan 06 15:04:05",
+	// "Sat, 25 Mar 95 22:34:21 -0500"
+	"Mon, 2 Jan 06 15:04:05 -0700",
+	// "Mon, 27 Mar 1995 14:54:12"
+	"Mon, 2 Jan 2006 15:04:05",
+	// "Sat, 18 Mar 95 21:05:28 PDT"
+	"Mon, 2 Jan 06 15:04:05 MST",
+	// "Sun, 19 Mar 1995 08:37:28 LOCAL"
+	"Mon, 2 Jan 2006 15:04:05 LOCAL",
+	// "Sat, 11 Mar 1995 12:17:31 UNDEFINED"
+	"Mon, 2 Jan 2006 15:04:05 UNDEFINED",
+	// "5 Feb 1995 11:01 -0500"
+	"2 Jan 2006 15:04 -0700",
+	// "Thu, 12 Jan 1995 23:01"
+	"Mon, 2 Jan 2006 15:04",
+	// "17 Dec 1994 01:04 CST"
+	"2 Jan 2006 15:04 MST",
+	// "12 Oct 94 16:11:03 +"
+	"2 Jan 06 15:04:05 +",
+	// "Tue, 31 May 1994  13:46 MET"
+	"Mon, 2 Jan 2006  15:04 MST",
+	// "Mon, 23 May 94 15:51:27 -0700 (PDT)"
+	"Mon, 2 Jan 06 15:04:05 -0700 (MST)",
+	// "Thu, 02 Dec 93 19:50:54 EST"
+	"Mon, 02 Jan 06 15:04:05 MST",
+	// "Monday, 12 Jul 1993 14:46:15 EDT"
+	"Monday, 2 Jan 2006 15:04:05 MST",
+}
+
+func parseLayouts(value string) (time.Time, bool) {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// zones are the offsets, in seconds, of the zone names found in old posts.
+// time.Parse gives unknown abbreviations an offset of zero, so we fix them up.
+var zones = map[string]int{
+	"UT": 0, "UTC": 0, "GMT": 0, "Z": 0,
+	"EST": -5 * 3600, "EDT": -4 * 3600,
+	"CST": -6 * 3600, "CDT": -5 * 3600,
+	"MST": -7 * 3600, "MDT": -6 * 3600,
+	"PST": -8 * 3600, "PDT": -7 * 3600,
+	"AST": -4 * 3600, "ADT": -3 * 3600,
+	"NST": -(3*3600 + 1800), "NDT": -(2*3600 + 1800),
+	"HST": -10 * 3600, "AKST": -9 * 3600, "AKDT": -8 * 3600,
+	"BST": 1 * 3600, "IST": 1 * 3600,
+	"WET": 0, "WEST": 1 * 3600,
+	"CET": 1 * 3600, "CEST": 2 * 3600, "MET": 1 * 3600, "MEST": 2 * 3600, "MEZ": 1 * 3600, "MESZ": 2 * 3600,
+	"EET": 2 * 3600, "EEST": 3 * 3600,
+	"MSK": 3 * 3600, "MSD": 4 * 3600,
+	"JST": 9 * 3600, "KST": 9 * 3600,
+	"AEST": 10 * 3600, "AEDT": 11 * 3600, "ACST": 9*3600 + 1800, "AWST": 8 * 3600,
+	"NZST": 12 * 3600, "NZDT": 13 * 3600,
+}
+
+// zoneNames are zone names written out by hand.
+var zoneNames = map[string]string{
+	"EASTERN":   "EST",
+	"CENTRAL":   "CST",
+	"MOUNTAIN":  "MST",
+	"PACIFIC":   "PST",
+	"LOCAL":     "+0000",
+	"UNDEFINED": "+0000",
+	"UNKNOWN":   "+0000",
+}
+
+// fixZone applies the offset for a known zone abbreviation that time.Parse
+// recorded with a zero offset.
+func fixZone(t time.Time) time.Time {
+	name, offset := t.Zone()
+	if offset != 0 {
+		return t
+	} else if zoneOffset, ok := zones[name]; ok && zoneOffset != 0 {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.FixedZone(name, zoneOffset))
+	}
+	return t
+}
+
+var (
+	reComment     = regexp.MustCompile(`\s*\([^)]*\)\s*$`)
+	reSpaces      = regexp.MustCompile(`\s+`)
+	reShortOffset = regexp.MustCompile(`^([+-])([0-9]{3})$`)                     // -500
+	reHourOffset  = regexp.MustCompile(`^(?:[A-Za-z]{1,3})?([+-])([0-9]{1,2})$`) // T-1, GMT+2, +2
+)
+
+// clean applies heuristics to a date that couldn't be parsed.
+// It removes comments and extra spaces and rewrites obsolete,
+// misspelled, or truncated zones into something that parses.
+func clean(value string) string {
+	value = reComment.ReplaceAllString(value, "")
+	value = strings.TrimSpace(reSpaces.ReplaceAllString(value, " "))
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return value
+	}
+	zone := fields[len(fields)-1]
+	upper := strings.ToUpper(zone)
+	if name, ok := zoneNames[upper]; ok {
+		zone = name
+	} else if _, ok := zones[upper]; ok {
+		zone = upper
+	} else if m := reShortOffset.FindStringSubmatch(zone); m != nil {
+		zone = m[1] + "0" + m[2]
+	} else if m := reHourOffset.FindStringSubmatch(zone); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		zone = fmt.Sprintf("%s%02d00", m[1], hours)
+	} else if zone == "+" || zone == "-" {
+		zone = ""
+	} else {
+		return value
+	}
+	fields[len(fields)-1] = zone
+	if offset, ok := zones[zone]; ok {
+		// net/mail only knows a few names, so use the offset instead
+		sign := "+"
+		if offset < 0 {
+			sign, offset = "-", -offset
+		}
+		fields[len(fields)-1] = fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+	}
+	return strings.TrimSpace(strings.Join(fields, " "))
+}
@@ -0,0 +1,219 @@
+// Package index implements a compact inverted index from words to documents.
+//
+// Documents are numbered densely from zero in the order they are added,
+// and each word has a compressed posting list of the documents that
+// contain it and the positions of the word in each.
+package index
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DocId is the number of a document in the index.
+type DocId uint32
+
+// Index maps words to the documents that contain them.
+// It is not safe for concurrent use while documents are being added.
+type Index struct {
+	words     map[string]*Postings
+	spellings map[string]map[string]int // how often each word is spelled each way
+	lengths   []uint32                  // number of words in each document
+	total     int                       // number of words in all the documents
+}
+
+// New returns an empty index.
+func New() *Index {
+	return &Index{words: make(map[string]*Postings), spellings: make(map[string]map[string]int)}
+}
+
+// Add adds a document with the positions of each word in it, in order,
+// and returns the DocId assigned to it.
+func (ix *Index) Add(words map[string][]int) DocId {
+	doc, length := DocId(len(ix.lengths)), 0
+	for word, positions := range words {
+		pl, ok := ix.words[word]
+		if !ok {
+			pl = &Postings{}
+			ix.words[word] = pl
+		}
+		pl.add(doc, positions)
+		length += len(positions)
+	}
+	ix.lengths = append(ix.lengths, uint32(length))
+	ix.total += length
+	return doc
+}
+
+// Spell counts how often each word in a document is spelled each way.
+// Words are stemmed, so the spellings are what a reader would recognize.
+func (ix *Index) Spell(spellings map[string]map[string]int) {
+	for word, counts := range spellings {
+		if ix.spellings[word] == nil {
+			ix.spellings[word] = make(map[string]int)
+		}
+		for spelling, n := range counts {
+			ix.spellings[word][spelling] += n
+		}
+	}
+}
+
+// Spellings returns how often a word is spelled each way.
+func (ix *Index) Spellings(word string) map[string]int {
+	return ix.spellings[word]
+}
+
+// Spelling returns the most common spelling of a word, or the word
+// itself if no spelling was counted.
+func (ix *Index) Spelling(word string) string {
+	return MostCommon(word, ix.spellings[word])
+}
+
+// MostCommon returns the spelling with the highest count, the first in
+// order if there is a tie, or the word if there are none.
+func MostCommon(word string, counts map[string]int) string {
+	best := ""
+	for spelling, n := range counts {
+		if best == "" || n > counts[best] || n == counts[best] && spelling < best {
+			best = spelling
+		}
+	}
+	if best == "" {
+		return word
+	}
+	return best
+}
+
+// Len returns the number of documents in the index.
+func (ix *Index) Len() int {
+	return len(ix.lengths)
+}
+
+// Length returns the number of words in a document.
+func (ix *Index) Length(doc DocId) int {
+	return int(ix.lengths[doc])
+}
+
+// Lookup returns the posting list for a word, or nil if no document contains it.
+func (ix *Index) Lookup(word string) *Postings {
+	return ix.words[word]
+}
+
+// Words returns every word in the index, sorted.
+func (ix *Index) Words() []string {
+	words := make([]string, 0, len(ix.words))
+	for word := range ix.words {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// Vocabulary returns the words that start with prefix and the number
+// of documents that contain each. An empty prefix returns every word.
+func (ix *Index) Vocabulary(prefix string) map[string]int {
+	words := make(map[string]int)
+	for word, pl := range ix.words {
+		if strings.HasPrefix(word, prefix) {
+			words[word] = pl.Len()
+		}
+	}
+	return words
+}
+
+// Search returns the documents that contain every word, in order.
+func (ix *Index) Search(words []string) []DocId {
+	if len(words) == 0 {
+		return nil
+	}
+	var lists []*Postings
+	for _, word := range words {
+		pl := ix.words[word]
+		if pl == nil {
+			return nil
+		}
+		lists = append(lists, pl)
+	}
+	return Intersect(lists...)
+}
+
+// Intersect returns the documents that are in every list, in order.
+// The shortest list leads and the others skip ahead to its documents.
+func Intersect(lists ...*Postings) []DocId {
+	if len(lists) == 0 {
+		return nil
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		return lists[i].Len() < lists[j].Len()
+	})
+	its := make([]*Iterator, len(lists))
+	for i, pl := range lists {
+		its[i] = pl.Iterator()
+	}
+
+	var docs []DocId
+	target := DocId(0)
+	for its[0].Advance(target) {
+		doc, found := its[0].Doc(), true
+		for _, it := range its[1:] {
+			if !it.Advance(doc) {
+				return docs
+			} else if it.Doc() != doc {
+				// no list can match before this document
+				target, found = it.Doc(), false
+				break
+			}
+		}
+		if found {
+			docs = append(docs, doc)
+			target = doc + 1
+		}
+	}
+	return docs
+}
+
+// gobIndex is the encoded form of an index.
+type gobIndex struct {
+	Words     map[string][]byte // the binary form of each posting list
+	Spellings map[string]map[string]int
+	Lengths   []uint32
+}
+
+func (ix *Index) GobEncode() ([]byte, error) {
+	g := gobIndex{Words: make(map[string][]byte, len(ix.words)), Spellings: ix.spellings, Lengths: ix.lengths}
+	for word, pl := range ix.words {
+		g.Words[word], _ = pl.MarshalBinary()
+	}
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (ix *Index) GobDecode(data []byte) error {
+	var g gobIndex
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&g); err != nil {
+		return err
+	}
+	ix.words, ix.spellings, ix.lengths, ix.total = make(map[string]*Postings, len(g.Words)), g.Spellings, g.Lengths, 0
+	if ix.spellings == nil {
+		ix.spellings = make(map[string]map[string]int)
+	}
+	for _, length := range ix.lengths {
+		ix.total += int(length)
+	}
+	for word, data := range g.Words {
+		pl := &Postings{}
+		if err := pl.UnmarshalBinary(data); err != nil {
+			return fmt.Errorf("index: %q: %w", word, err)
+		} else if pl.Len() != 0 && int(pl.last) >= len(ix.lengths) {
+			return fmt.Errorf("index: %q: document %d out of range", word, pl.last)
+		}
+		ix.words[word] = pl
+	}
+	return nil
+}
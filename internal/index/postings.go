@@ -0,0 +1,196 @@
+package index
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// skipInterval is the number of postings between entries in the skip list.
+const skipInterval = 64
+
+// Postings is the list of documents containing a word, in increasing
+// order of DocId, with the positions of the word in each.
+//
+// Each posting is stored as three varints, the gap from the previous DocId,
+// the count, and the size of the positions, followed by the gaps between
+// the positions as varints. The size lets an Iterator step over positions
+// that aren't needed, and a skip list lets it jump over blocks of postings
+// without decoding them.
+type Postings struct {
+	data  []byte
+	count int
+	last  DocId  // the last DocId added
+	skips []skip // the start of every skipInterval-th posting
+}
+
+// skip is the start of a block of postings.
+type skip struct {
+	base   DocId // the DocId before the block
+	offset int   // offset of the block in data
+	n      int   // number of postings before the block
+}
+
+// add appends a posting with the positions of the word in the document,
+// in increasing order. Documents must be added in increasing order.
+func (pl *Postings) add(doc DocId, positions []int) {
+	var data []byte
+	last := 0
+	for _, pos := range positions {
+		data = binary.AppendUvarint(data, uint64(pos-last))
+		last = pos
+	}
+	pl.addEncoded(doc, len(positions), data)
+}
+
+// addEncoded appends a posting with the positions already encoded.
+func (pl *Postings) addEncoded(doc DocId, count int, positions []byte) {
+	if pl.count%skipInterval == 0 {
+		pl.skips = append(pl.skips, skip{base: pl.last, offset: len(pl.data), n: pl.count})
+	}
+	pl.data = binary.AppendUvarint(pl.data, uint64(doc-pl.last))
+	pl.data = binary.AppendUvarint(pl.data, uint64(count))
+	pl.data = binary.AppendUvarint(pl.data, uint64(len(positions)))
+	pl.data = append(pl.data, positions...)
+	pl.count, pl.last = pl.count+1, doc
+}
+
+// Append adds the postings of another list to the end of this one, adding
+// base to each DocId. The shifted DocIds must come after those in the list,
+// so lists built for consecutive runs of documents can be joined.
+func (pl *Postings) Append(other *Postings, base DocId) {
+	for it := other.Iterator(); it.Next(); {
+		pl.addEncoded(base+it.Doc(), it.Count(), it.positions)
+	}
+}
+
+// MarshalBinary encodes the list as the number of postings followed by the postings.
+func (pl *Postings) MarshalBinary() ([]byte, error) {
+	data := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(pl.data)), uint64(pl.count))
+	return append(data, pl.data...), nil
+}
+
+// UnmarshalBinary decodes a list encoded by MarshalBinary.
+// The postings are added again to rebuild the skip list.
+func (pl *Postings) UnmarshalBinary(data []byte) error {
+	*pl = Postings{}
+	count, pos := binary.Uvarint(data)
+	if pos <= 0 {
+		return fmt.Errorf("bad posting count")
+	}
+	pl.data = make([]byte, 0, len(data)-pos)
+	for n := uint64(0); n < count; n++ {
+		var fields [3]uint64
+		for i := range fields {
+			v, k := binary.Uvarint(data[pos:])
+			if k <= 0 {
+				return fmt.Errorf("bad posting %d", n)
+			}
+			fields[i], pos = v, pos+k
+		}
+		gap, freq, size := fields[0], fields[1], fields[2]
+		if size > uint64(len(data)-pos) {
+			return fmt.Errorf("bad posting %d", n)
+		}
+		pl.addEncoded(pl.last+DocId(gap), int(freq), data[pos:pos+int(size)])
+		pos += int(size)
+	}
+	return nil
+}
+
+// Len returns the number of documents in the list.
+func (pl *Postings) Len() int {
+	if pl == nil {
+		return 0
+	}
+	return pl.count
+}
+
+// Docs returns every DocId in the list.
+func (pl *Postings) Docs() []DocId {
+	docs := make([]DocId, 0, pl.Len())
+	for it := pl.Iterator(); it.Next(); {
+		docs = append(docs, it.Doc())
+	}
+	return docs
+}
+
+// Iterator returns an iterator positioned before the first posting.
+func (pl *Postings) Iterator() *Iterator {
+	if pl == nil {
+		pl = &Postings{}
+	}
+	return &Iterator{pl: pl}
+}
+
+// Iterator walks a posting list in order.
+type Iterator struct {
+	pl        *Postings
+	pos       int // offset of the next posting in data
+	n         int // number of postings read
+	doc       DocId
+	count     int
+	positions []byte // the encoded positions in the current document
+}
+
+// Next moves to the next posting. It returns false at the end of the list.
+func (it *Iterator) Next() bool {
+	if it.n >= it.pl.count {
+		return false
+	}
+	gap, k := binary.Uvarint(it.pl.data[it.pos:])
+	it.pos += k
+	count, k := binary.Uvarint(it.pl.data[it.pos:])
+	it.pos += k
+	size, k := binary.Uvarint(it.pl.data[it.pos:])
+	it.pos += k
+	it.positions = it.pl.data[it.pos : it.pos+int(size)]
+	it.pos += int(size)
+	it.n, it.doc, it.count = it.n+1, it.doc+DocId(gap), int(count)
+	return true
+}
+
+// Advance moves to the first posting at or after target, skipping
+// blocks that can't contain it. It never moves backwards.
+// It returns false if there is no such posting.
+func (it *Iterator) Advance(target DocId) bool {
+	if it.n != 0 && it.doc >= target {
+		return true
+	}
+	skips := it.pl.skips
+	if j := sort.Search(len(skips), func(j int) bool { return skips[j].base >= target }) - 1; j >= 0 && skips[j].n > it.n {
+		it.pos, it.n, it.doc = skips[j].offset, skips[j].n, skips[j].base
+	}
+	for it.Next() {
+		if it.doc >= target {
+			return true
+		}
+	}
+	return false
+}
+
+// Doc returns the DocId of the current posting.
+func (it *Iterator) Doc() DocId {
+	return it.doc
+}
+
+// Count returns the number of times the word appears in the current document.
+func (it *Iterator) Count() int {
+	return it.count
+}
+
+// Positions returns the positions of the word in the current document, in order.
+func (it *Iterator) Positions() []int {
+	positions := make([]int, 0, it.count)
+	pos := 0
+	for data := it.positions; len(data) != 0; {
+		gap, k := binary.Uvarint(data)
+		if k <= 0 {
+			break
+		}
+		pos += int(gap)
+		positions = append(positions, pos)
+		data = data[k:]
+	}
+	return positions
+}
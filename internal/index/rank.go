@@ -0,0 +1,113 @@
+package index
+
+import (
+	"math"
+	"sort"
+)
+
+// BM25 parameters.
+const (
+	k1 = 1.2  // how quickly repeated words stop adding to the score
+	b  = 0.75 // how much the length of a document counts against it
+)
+
+// Hit is a document that matched a query and its score.
+type Hit struct {
+	Doc   DocId
+	Score float64
+}
+
+// Stats are the totals for a collection of documents, used to rank them.
+type Stats struct {
+	Documents int                 // number of documents in the collection
+	Words     int                 // number of words in all the documents
+	Length    func(doc DocId) int // number of words in a document
+}
+
+// Rank scores the documents that contain every word with BM25 and
+// returns them best first. Documents with the same score are in order.
+func (ix *Index) Rank(words []string) []Hit {
+	var lists []*Postings
+	for _, word := range words {
+		pl := ix.words[word]
+		if pl == nil {
+			return nil
+		}
+		lists = append(lists, pl)
+	}
+	return Rank(lists, ix.Stats())
+}
+
+// Stats returns the totals for the documents in the index.
+func (ix *Index) Stats() Stats {
+	return Stats{Documents: len(ix.lengths), Words: ix.total, Length: ix.Length}
+}
+
+// Rank scores the documents that are in every list with BM25 and
+// returns them best first. Documents with the same score are in order.
+func Rank(lists []*Postings, stats Stats) []Hit {
+	lists = unique(lists)
+	return Score(Intersect(lists...), lists, stats)
+}
+
+// Score scores the documents with BM25 for the words in the lists and
+// returns them best first. A document doesn't have to be in every list.
+// Documents with the same score are in order.
+func Score(docs []DocId, lists []*Postings, stats Stats) []Hit {
+	if len(docs) == 0 {
+		return nil
+	}
+	hits := make([]Hit, len(docs))
+	for i, doc := range docs {
+		hits[i].Doc = doc
+	}
+
+	avgLength := float64(stats.Words) / float64(stats.Documents)
+	for _, pl := range unique(lists) {
+		n := float64(pl.Len())
+		idf := math.Log(1 + (float64(stats.Documents)-n+0.5)/(n+0.5))
+		it := pl.Iterator()
+		for i := range hits {
+			if !it.Advance(hits[i].Doc) {
+				break
+			} else if it.Doc() != hits[i].Doc {
+				continue
+			}
+			tf := float64(it.Count())
+			norm := 1 - b + b*float64(stats.Length(hits[i].Doc))/avgLength
+			hits[i].Score += idf * tf * (k1 + 1) / (tf + k1*norm)
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		return hits[i].Score > hits[j].Score
+	})
+	return hits
+}
+
+// Page returns limit results starting at offset. If limit is zero or less,
+// it returns every result from offset on.
+func Page[T any](results []T, offset, limit int) []T {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(results) {
+		return nil
+	} else if limit <= 0 || offset+limit > len(results) {
+		return results[offset:]
+	}
+	return results[offset : offset+limit]
+}
+
+// unique removes repeated lists, so that a word repeated in a query
+// isn't counted twice.
+func unique(lists []*Postings) []*Postings {
+	var set []*Postings
+	seen := make(map[*Postings]bool)
+	for _, pl := range lists {
+		if !seen[pl] {
+			seen[pl] = true
+			set = append(set, pl)
+		}
+	}
+	return set
+}
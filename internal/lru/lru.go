@@ -0,0 +1,69 @@
+// Package lru implements a small least-recently-used cache.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache holds up to a fixed number of values, dropping the least
+// recently used value when it is full. It is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	sync.Mutex
+	size  int
+	order *list.List // front is the most recently used
+	items map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+// New returns a cache that holds up to size values.
+func New[K comparable, V any](size int) *Cache[K, V] {
+	if size < 1 {
+		size = 1
+	}
+	return &Cache[K, V]{
+		size:  size,
+		order: list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value for the key and marks it as recently used.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*entry[K, V]).value, true
+	}
+	var zero V
+	return zero, false
+}
+
+// Add adds or replaces the value for the key.
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.items[key]; ok {
+		e.Value.(*entry[K, V]).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&entry[K, V]{key: key, value: value})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry[K, V]).key)
+	}
+}
+
+// Len returns the number of values in the cache.
+func (c *Cache[K, V]) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,516 @@
+package query
+
+import (
+	"fmt"
+	"github.com/mdhender/mbox/internal/index"
+	"github.com/mdhender/mbox/internal/stores"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Index is the collection of documents that a query is run against.
+type Index interface {
+	// Stats returns the totals used to rank documents.
+	Stats() index.Stats
+	// Lookup returns the posting list for a stemmed word, or nil if no
+	// document contains it.
+	Lookup(word string) (*index.Postings, error)
+	// Meta returns what most fields and the facets need to know about
+	// a document. It is called for every document they look at, so it
+	// should not have to read the post.
+	Meta(doc index.DocId) (*Meta, error)
+	// Doc returns the headers of a document for matching the from and
+	// subject fields and labelling facets.
+	Doc(doc index.DocId) (*Doc, error)
+	// Vocabulary returns the stemmed words that start with prefix and
+	// the number of documents that contain each.
+	Vocabulary(prefix string) (map[string]int, error)
+	// Spelling returns the most common spelling of a stemmed word in
+	// the documents, or the word itself if it isn't known.
+	Spelling(word string) (string, error)
+}
+
+// Meta is the part of a post that most fields and the facets use,
+// which is small enough for a store to keep for every document.
+type Meta struct {
+	Author       string // key for the posts from the sender
+	Thread       string // ShaId of the post that started the thread; see Thread
+	Date         time.Time
+	Attachments  int
+	References   int // number of posts the post refers to
+	Missing      int // number of those that aren't in the archive
+	ReferencedBy int // number of posts that refer to the post
+}
+
+// Doc is the part of a post that fields are matched against.
+type Doc struct {
+	Meta
+	From        string // display name of the sender
+	FromAddress string
+	Subject     string
+}
+
+// Search parses the input and runs it against the index. It returns the
+// total, the words to highlight, the facets, and a suggestion if nothing
+// matched, along with the page of hits from offset, best first. The
+// store fills in the posts for the hits.
+func Search(input string, stopWords map[string]bool, ix Index, offset, limit int) (*stores.SearchResults, []index.Hit, error) {
+	q, err := Parse(input, stopWords)
+	if err != nil {
+		return nil, nil, err
+	} else if q, err = Expand(q, ix); err != nil {
+		return nil, nil, err
+	}
+	hits, err := Run(q, ix)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := &stores.SearchResults{Total: len(hits), Words: Words(q)}
+	if len(hits) == 0 {
+		if results.Suggestion, err = Suggest(input, stopWords, ix); err != nil {
+			return nil, nil, err
+		}
+	}
+	if results.Facets, err = Facets(hits, ix); err != nil {
+		return nil, nil, err
+	}
+	return results, index.Page(hits, offset, limit), nil
+}
+
+// Run finds the documents that match the query and ranks them with BM25
+// on the words that they must contain, best first. Prefixes and fuzzy
+// words must already have been replaced by Expand.
+func Run(q Node, ix Index) ([]index.Hit, error) {
+	if q == nil {
+		return nil, nil
+	}
+	r := &runner{ix: ix, stats: ix.Stats(), lists: make(map[string]*index.Postings)}
+	docs, err := r.eval(q, nil)
+	if err != nil {
+		return nil, err
+	}
+	var lists []*index.Postings
+	for _, word := range Words(q) {
+		if pl, err := r.lookup(word); err != nil {
+			return nil, err
+		} else if pl != nil {
+			lists = append(lists, pl)
+		}
+	}
+	return index.Score(docs, lists, r.stats), nil
+}
+
+// Words returns the stemmed words in the query that aren't negated,
+// which are the words that matching documents are ranked on.
+func Words(q Node) []string {
+	return words(q, nil)
+}
+
+func words(q Node, list []string) []string {
+	switch n := q.(type) {
+	case And:
+		for _, child := range n {
+			list = words(child, list)
+		}
+	case Or:
+		for _, child := range n {
+			list = words(child, list)
+		}
+	case Term:
+		list = append(list, n.Word)
+	case Phrase:
+		list = append(list, n.Words...)
+	case Near:
+		list = words(n.Right, words(n.Left, list))
+	}
+	return list
+}
+
+// runner evaluates a query, caching the posting lists it reads.
+type runner struct {
+	ix    Index
+	stats index.Stats
+	lists map[string]*index.Postings
+}
+
+func (r *runner) lookup(word string) (*index.Postings, error) {
+	if pl, ok := r.lists[word]; ok {
+		return pl, nil
+	}
+	pl, err := r.ix.Lookup(word)
+	if err != nil {
+		return nil, err
+	}
+	r.lists[word] = pl
+	return pl, nil
+}
+
+// eval returns the documents in within that match the node, in order.
+// If within is nil, every document is considered.
+func (r *runner) eval(q Node, within []index.DocId) ([]index.DocId, error) {
+	switch n := q.(type) {
+	case And:
+		// the cheapest nodes narrow the documents for the rest
+		children := append(And{}, n...)
+		costs := make(map[int]int)
+		for i, child := range children {
+			costs[i] = r.cost(child)
+		}
+		order := make([]int, len(children))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return costs[order[i]] < costs[order[j]]
+		})
+		docs := within
+		for _, i := range order {
+			var err error
+			if docs, err = r.eval(children[i], docs); err != nil {
+				return nil, err
+			} else if len(docs) == 0 {
+				return nil, nil
+			}
+		}
+		return docs, nil
+	case Or:
+		var docs []index.DocId
+		for _, child := range n {
+			found, err := r.eval(child, within)
+			if err != nil {
+				return nil, err
+			}
+			docs = union(docs, found)
+		}
+		return docs, nil
+	case Not:
+		found, err := r.eval(n.Node, within)
+		if err != nil {
+			return nil, err
+		}
+		return difference(r.all(within), found), nil
+	case Term:
+		pl, err := r.lookup(n.Word)
+		if err != nil || pl == nil {
+			return nil, err
+		}
+		return intersect(pl.Docs(), within), nil
+	case Phrase:
+		var lists []*index.Postings
+		for _, word := range n.Words {
+			pl, err := r.lookup(word)
+			if err != nil || pl == nil {
+				return nil, err
+			}
+			lists = append(lists, pl)
+		}
+		return r.filter(n, intersect(index.Intersect(lists...), within))
+	case Near:
+		docs, err := r.eval(n.Left, within)
+		if err != nil || len(docs) == 0 {
+			return nil, err
+		} else if docs, err = r.eval(n.Right, docs); err != nil || len(docs) == 0 {
+			return nil, err
+		}
+		return r.filter(n, docs)
+	case Field:
+		var docs []index.DocId
+		for _, doc := range r.all(within) {
+			if ok, err := r.match(n, doc); err != nil {
+				return nil, err
+			} else if ok {
+				docs = append(docs, doc)
+			}
+		}
+		return docs, nil
+	}
+	return nil, nil
+}
+
+// cost estimates how many documents a node has to look at.
+func (r *runner) cost(q Node) int {
+	switch n := q.(type) {
+	case Term:
+		pl, _ := r.lookup(n.Word)
+		return pl.Len()
+	case Phrase:
+		cost := r.stats.Documents
+		for _, word := range n.Words {
+			pl, _ := r.lookup(word)
+			if pl.Len() < cost {
+				cost = pl.Len()
+			}
+		}
+		return cost
+	case Near:
+		return min(r.cost(n.Left), r.cost(n.Right))
+	case Or:
+		cost := 0
+		for _, child := range n {
+			cost += r.cost(child)
+		}
+		return cost
+	case And:
+		cost := r.stats.Documents
+		for _, child := range n {
+			if c := r.cost(child); c < cost {
+				cost = c
+			}
+		}
+		return cost
+	}
+	// fields and negations look at every document
+	return 2 * r.stats.Documents
+}
+
+// filter returns the documents where the words of a Phrase or Near
+// node are at the right positions.
+func (r *runner) filter(q Node, docs []index.DocId) ([]index.DocId, error) {
+	m, err := r.matcher(q)
+	if err != nil {
+		return nil, err
+	}
+	var found []index.DocId
+	for _, doc := range docs {
+		if len(m.spans(doc)) != 0 {
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+// span is the positions of the first and last words of a match in a document.
+type span struct {
+	start, end int
+}
+
+// matcher finds the matches for a node in a document. Documents must
+// be given in increasing order.
+type matcher interface {
+	spans(doc index.DocId) []span
+}
+
+func (r *runner) matcher(q Node) (matcher, error) {
+	switch n := q.(type) {
+	case Term:
+		pl, err := r.lookup(n.Word)
+		if err != nil {
+			return nil, err
+		}
+		return &phraseMatcher{its: []*index.Iterator{pl.Iterator()}, offsets: []int{0}}, nil
+	case Phrase:
+		m := &phraseMatcher{offsets: n.Offsets}
+		for _, word := range n.Words {
+			pl, err := r.lookup(word)
+			if err != nil {
+				return nil, err
+			}
+			m.its = append(m.its, pl.Iterator())
+		}
+		return m, nil
+	case Near:
+		left, err := r.matcher(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := r.matcher(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return &nearMatcher{left: left, right: right, distance: n.Distance}, nil
+	case Or:
+		m := orMatcher{}
+		for _, child := range n {
+			child, err := r.matcher(child)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, child)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("query: can't match positions of %T", q)
+}
+
+// phraseMatcher matches words at fixed offsets from the first word.
+type phraseMatcher struct {
+	its     []*index.Iterator
+	offsets []int
+}
+
+func (m *phraseMatcher) spans(doc index.DocId) []span {
+	positions := make([][]int, len(m.its))
+	for i, it := range m.its {
+		if !it.Advance(doc) || it.Doc() != doc {
+			return nil
+		}
+		positions[i] = it.Positions()
+	}
+	var spans []span
+	last := m.offsets[len(m.offsets)-1]
+	for _, start := range positions[0] {
+		found := true
+		for i := 1; i < len(positions) && found; i++ {
+			want := start + m.offsets[i]
+			j := sort.SearchInts(positions[i], want)
+			found = j < len(positions[i]) && positions[i][j] == want
+		}
+		if found {
+			spans = append(spans, span{start: start, end: start + last})
+		}
+	}
+	return spans
+}
+
+// orMatcher matches any of its matchers, which a prefix or fuzzy word
+// is expanded to.
+type orMatcher []matcher
+
+func (m orMatcher) spans(doc index.DocId) []span {
+	var spans []span
+	for _, child := range m {
+		spans = append(spans, child.spans(doc)...)
+	}
+	return spans
+}
+
+// nearMatcher matches two nodes that are within distance words of each other.
+type nearMatcher struct {
+	left, right matcher
+	distance    int
+}
+
+func (m *nearMatcher) spans(doc index.DocId) []span {
+	left, right := m.left.spans(doc), m.right.spans(doc)
+	var spans []span
+	for _, a := range left {
+		for _, b := range right {
+			if max(a.start, b.start)-min(a.end, b.end) <= m.distance {
+				spans = append(spans, span{start: min(a.start, b.start), end: max(a.end, b.end)})
+			}
+		}
+	}
+	return spans
+}
+
+// all returns within, or every document if within is nil.
+func (r *runner) all(within []index.DocId) []index.DocId {
+	if within != nil {
+		return within
+	}
+	docs := make([]index.DocId, r.stats.Documents)
+	for i := range docs {
+		docs[i] = index.DocId(i)
+	}
+	return docs
+}
+
+// match reports whether a document matches a field.
+// Only the from and subject fields read the headers of the document.
+func (r *runner) match(f Field, doc index.DocId) (bool, error) {
+	if f.Name == "from" || f.Name == "subject" {
+		d, err := r.ix.Doc(doc)
+		if err != nil {
+			return false, err
+		}
+		return f.match(d), nil
+	}
+	m, err := r.ix.Meta(doc)
+	if err != nil {
+		return false, err
+	}
+	return f.match(&Doc{Meta: *m}), nil
+}
+
+// match reports whether the document matches the field.
+func (f Field) match(d *Doc) bool {
+	switch f.Name {
+	case "from":
+		return strings.Contains(strings.ToLower(d.From), f.Value) || strings.Contains(d.FromAddress, f.Value)
+	case "subject":
+		return strings.Contains(strings.ToLower(d.Subject), f.Value)
+	case "before":
+		return d.Date.Before(f.Date)
+	case "after":
+		return !d.Date.Before(f.Date)
+	case "year":
+		return strconv.Itoa(d.Date.Year()) == f.Value
+	case "month":
+		return d.Date.Year() == f.Date.Year() && d.Date.Month() == f.Date.Month()
+	case "author":
+		return d.Author == f.Value
+	case "thread":
+		return d.Thread == f.Value
+	case "has":
+		switch f.Value {
+		case "references":
+			return d.References != 0
+		case "replies":
+			return d.ReferencedBy != 0
+		case "attachments":
+			return d.Attachments != 0
+		}
+	case "is":
+		return f.Value == "orphan" && d.Missing != 0 && d.Missing == d.References
+	}
+	return false
+}
+
+// intersect returns the documents in a that are also in within.
+// If within is nil, it returns a.
+func intersect(a, within []index.DocId) []index.DocId {
+	if within == nil {
+		return a
+	}
+	var docs []index.DocId
+	for i, j := 0, 0; i < len(a) && j < len(within); {
+		switch {
+		case a[i] < within[j]:
+			i++
+		case a[i] > within[j]:
+			j++
+		default:
+			docs = append(docs, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	return docs
+}
+
+// union returns the documents in either list.
+func union(a, b []index.DocId) []index.DocId {
+	docs := make([]index.DocId, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			docs = append(docs, a[i])
+			i++
+		case a[i] > b[j]:
+			docs = append(docs, b[j])
+			j++
+		default:
+			docs = append(docs, a[i])
+			i, j = i+1, j+1
+		}
+	}
+	docs = append(docs, a[i:]...)
+	return append(docs, b[j:]...)
+}
+
+// difference returns the documents in a that aren't in b.
+func difference(a, b []index.DocId) []index.DocId {
+	var docs []index.DocId
+	j := 0
+	for _, doc := range a {
+		for j < len(b) && b[j] < doc {
+			j++
+		}
+		if j == len(b) || b[j] != doc {
+			docs = append(docs, doc)
+		}
+	}
+	return docs
+}
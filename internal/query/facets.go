@@ -0,0 +1,157 @@
+package query
+
+import (
+	"github.com/mdhender/mbox/internal/index"
+	"github.com/mdhender/mbox/internal/stores"
+	"sort"
+	"strings"
+)
+
+// maxFacets is the number of months, senders, and threads returned.
+const maxFacets = 10
+
+// Facets counts the documents that matched a query by year, month,
+// sender, and thread. The counts only need the Meta of each document;
+// the headers are read for the labels of the senders and threads kept.
+func Facets(hits []index.Hit, ix Index) (*stores.Facets, error) {
+	years, months := make(map[string]*stores.Facet), make(map[string]*stores.Facet)
+	authors, threads := make(map[string]*stores.Facet), make(map[string]*stores.Facet)
+	labels := make(map[*stores.Facet]index.DocId) // the document each facet is labelled from
+	started := make(map[string]*Meta)             // the oldest document seen in each thread
+	count := func(facets map[string]*stores.Facet, name, value, label string) *stores.Facet {
+		f, ok := facets[value]
+		if !ok {
+			f = &stores.Facet{Query: fieldQuery(name, value), Label: label}
+			facets[value] = f
+		}
+		f.Count++
+		return f
+	}
+	for _, hit := range hits {
+		m, err := ix.Meta(hit.Doc)
+		if err != nil {
+			return nil, err
+		}
+		count(years, "year", m.Date.Format("2006"), m.Date.Format("2006"))
+		count(months, "month", m.Date.Format("2006-01"), m.Date.Format("January 2006"))
+		if m.Author != "" {
+			// senders are labelled with the name in their first post
+			if f := count(authors, "author", m.Author, ""); f.Count == 1 {
+				labels[f] = hit.Doc
+			}
+		}
+		f := count(threads, "thread", m.Thread, "")
+		if first, ok := started[m.Thread]; !ok || m.Date.Before(first.Date) {
+			started[m.Thread], labels[f] = m, hit.Doc
+		}
+	}
+
+	facets := &stores.Facets{
+		Years:   sorted(years, 0, true),
+		Months:  sorted(months, maxFacets, true),
+		Authors: sorted(authors, maxFacets, false),
+		Threads: sorted(threads, maxFacets, false),
+	}
+	for _, f := range facets.Authors {
+		d, err := ix.Doc(labels[f])
+		if err != nil {
+			return nil, err
+		} else if f.Label = d.From; f.Label == "" {
+			f.Label = d.Author
+		}
+	}
+	for _, f := range facets.Threads {
+		d, err := ix.Doc(labels[f])
+		if err != nil {
+			return nil, err
+		}
+		f.Label = trimReplies(d.Subject)
+	}
+	return facets, nil
+}
+
+// sorted returns the facets with the most documents, most first, keeping
+// at most limit if it isn't zero. If byQuery is set, the facets that are
+// kept are sorted by their query instead, which puts dates in order.
+// Facets that can't be written as a query are dropped.
+func sorted(facets map[string]*stores.Facet, limit int, byQuery bool) []*stores.Facet {
+	var list []*stores.Facet
+	for _, f := range facets {
+		if f.Query != "" {
+			list = append(list, f)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Query < list[j].Query
+	})
+	if limit != 0 && len(list) > limit {
+		list = list[:limit]
+	}
+	if byQuery {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Query < list[j].Query
+		})
+	}
+	return list
+}
+
+// fieldQuery returns the query for a field, quoting the value if needed,
+// or an empty string if the value can't be quoted.
+func fieldQuery(name, value string) string {
+	if strings.Contains(value, `"`) {
+		return ""
+	} else if strings.ContainsAny(value, " \t\n\r()") {
+		return name + `:"` + value + `"`
+	}
+	return name + ":" + value
+}
+
+// Narrow returns the input with a facet's query added. The input is put
+// in parentheses if it has an OR that would otherwise take the query as
+// one of its choices.
+func Narrow(input, facet string) string {
+	depth := 0
+	for _, t := range lex(input) {
+		if t.quoted {
+			continue
+		} else if t.text == "(" {
+			depth++
+		} else if t.text == ")" {
+			depth--
+		} else if t.text == "OR" && depth == 0 {
+			return "(" + input + ") " + facet
+		}
+	}
+	return input + " " + facet
+}
+
+// trimReplies removes the "Re:" prefixes from a subject.
+func trimReplies(subject string) string {
+	for {
+		subject = strings.TrimSpace(subject)
+		if len(subject) < 3 || !strings.EqualFold(subject[:3], "re:") {
+			return subject
+		}
+		subject = subject[3:]
+	}
+}
+
+// Thread returns the ShaId of the post that started the thread a post
+// is in, which is taken to be the oldest post it references, or the
+// post itself if it references none. Ties are broken by ShaId so that
+// every store picks the same post.
+func Thread(shaId string, references []*stores.Summary) string {
+	var oldest *stores.Summary
+	for _, ref := range references {
+		if oldest == nil || ref.Date.Before(oldest.Date) || ref.Date.Equal(oldest.Date) && ref.ShaId < oldest.ShaId {
+			oldest = ref
+		}
+	}
+	if oldest == nil {
+		return shaId
+	}
+	return oldest.ShaId
+}
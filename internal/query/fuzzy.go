@@ -0,0 +1,230 @@
+package query
+
+import (
+	"github.com/mdhender/mbox/internal/chunk"
+	"sort"
+	"strings"
+)
+
+const (
+	maxFuzziness  = 2  // most edits allowed for a fuzzy word
+	maxExpansions = 50 // most words a prefix or fuzzy word is expanded to
+)
+
+// fuzziness returns the number of edits allowed for a fuzzy word when
+// the query doesn't give one. Short words allow fewer so that they
+// don't match everything.
+func fuzziness(word string) int {
+	if len(word) <= 5 {
+		return 1
+	}
+	return maxFuzziness
+}
+
+// Expand replaces the prefixes and fuzzy words in the query with the
+// words in the index that they match. A prefix or fuzzy word that
+// matches nothing is replaced with an empty Or.
+func Expand(q Node, ix Index) (Node, error) {
+	e := &expander{ix: ix}
+	return e.expand(q)
+}
+
+// expander reads the vocabulary of the index at most once.
+type expander struct {
+	ix    Index
+	words map[string]int
+}
+
+func (e *expander) expand(q Node) (Node, error) {
+	switch n := q.(type) {
+	case And:
+		expanded := And{}
+		for _, child := range n {
+			child, err := e.expand(child)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, child)
+		}
+		return expanded, nil
+	case Or:
+		expanded := Or{}
+		for _, child := range n {
+			child, err := e.expand(child)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, child)
+		}
+		return expanded, nil
+	case Not:
+		child, err := e.expand(n.Node)
+		if err != nil {
+			return nil, err
+		}
+		return Not{Node: child}, nil
+	case Near:
+		left, err := e.expand(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := e.expand(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		return Near{Left: left, Right: right, Distance: n.Distance}, nil
+	case Prefix:
+		words, err := e.ix.Vocabulary(n.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		return terms(words, nil), nil
+	case Fuzzy:
+		if e.words == nil {
+			var err error
+			if e.words, err = e.ix.Vocabulary(""); err != nil {
+				return nil, err
+			}
+		}
+		words, edits := make(map[string]int), make(map[string]int)
+		for word, docs := range e.words {
+			if d := distance(n.Word, word, n.Distance); d <= n.Distance {
+				words[word], edits[word] = docs, d
+			}
+		}
+		return terms(words, edits), nil
+	}
+	return q, nil
+}
+
+// terms returns a Term for each word, or an Or of them if there is more
+// than one. Only the closest and most common words are kept.
+func terms(docs, edits map[string]int) Node {
+	var words []string
+	for word := range docs {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		a, b := words[i], words[j]
+		if edits[a] != edits[b] {
+			return edits[a] < edits[b]
+		} else if docs[a] != docs[b] {
+			return docs[a] > docs[b]
+		}
+		return a < b
+	})
+	if len(words) > maxExpansions {
+		words = words[:maxExpansions]
+	}
+	if len(words) == 1 {
+		return Term{Word: words[0]}
+	}
+	expanded := Or{}
+	for _, word := range words {
+		expanded = append(expanded, Term{Word: word})
+	}
+	return expanded
+}
+
+// distance returns the number of insertions, deletions, substitutions,
+// and swaps of neighbouring letters that turn a into b. It stops counting
+// once it knows the distance is more than limit.
+func distance(a, b string, limit int) int {
+	if d := len(a) - len(b); d > limit || -d > limit {
+		return limit + 1
+	}
+	// rows for the previous two letters of a and the current one
+	prev2, prev, row := make([]int, len(b)+1), make([]int, len(b)+1), make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		row[0] = i
+		smallest := row[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			row[j] = min(prev[j]+1, row[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				row[j] = min(row[j], prev2[j-2]+1)
+			}
+			smallest = min(smallest, row[j])
+		}
+		if smallest > limit {
+			return limit + 1
+		}
+		prev2, prev, row = prev, row, prev2
+	}
+	return prev[len(b)]
+}
+
+// Suggest returns the input with each word that isn't in the index
+// replaced by the most common spelling of the closest word that is, or
+// an empty string if there is no such query that finds anything.
+// Phrases, fields, and negated words are left alone.
+func Suggest(input string, stopWords map[string]bool, ix Index) (string, error) {
+	var vocabulary map[string]int
+	suggestion, changed := input, false
+	tokens := lex(input)
+	// replace from the end so that the positions of earlier words don't move
+	for i := len(tokens) - 1; i >= 0; i-- {
+		t := tokens[i]
+		if t.quoted || t.negated || strings.ContainsAny(t.text, ":*~") {
+			continue
+		}
+		words := chunk.Tokens([]byte(t.text), stopWords)
+		if len(words) != 1 || isNear(t.text) {
+			continue
+		}
+		word := string(words[0].Word)
+		if pl, err := ix.Lookup(word); err != nil {
+			return "", err
+		} else if pl != nil {
+			continue
+		}
+		if vocabulary == nil {
+			var err error
+			if vocabulary, err = ix.Vocabulary(""); err != nil {
+				return "", err
+			}
+		}
+		// the closest word, then the most common
+		best, bestEdits := "", fuzziness(word)+1
+		for candidate, docs := range vocabulary {
+			d := distance(word, candidate, fuzziness(word))
+			if d > fuzziness(word) {
+				continue
+			} else if d < bestEdits || d == bestEdits && (docs > vocabulary[best] || docs == vocabulary[best] && candidate < best) {
+				best, bestEdits = candidate, d
+			}
+		}
+		if best == "" {
+			continue
+		}
+		// suggest the word as it is spelled in the posts rather than its stem
+		spelling, err := ix.Spelling(best)
+		if err != nil {
+			return "", err
+		}
+		start, end := t.pos+words[0].Start, t.pos+words[0].End
+		suggestion, changed = suggestion[:start]+spelling+suggestion[end:], true
+	}
+	if !changed {
+		return "", nil
+	}
+
+	// only suggest a query that finds something
+	q, err := Parse(suggestion, stopWords)
+	if err != nil {
+		return "", nil
+	} else if q, err = Expand(q, ix); err != nil {
+		return "", err
+	}
+	hits, err := Run(q, ix)
+	if err != nil || len(hits) == 0 {
+		return "", err
+	}
+	return suggestion, nil
+}
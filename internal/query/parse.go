@@ -0,0 +1,465 @@
+// Package query parses search queries and runs them against an index.
+//
+// A query is a list of words, all of which must be in a post:
+//
+//	fleet galaxy            posts with both words
+//	fleet OR navy           posts with either word
+//	fleet -navy             posts with fleet but not navy (NOT navy also works)
+//	(fleet OR navy) army    parentheses group words
+//	"play by mail"          posts with the phrase
+//	fleet NEAR/5 galaxy     posts with the words within 5 words of each other
+//	fleet NEAR galaxy       the same, within 10 words
+//	morgh*                  posts with a word that starts with morgh
+//	morghool~               posts with a word spelled like morghool
+//	morghool~1              the same, with at most 1 letter wrong
+//
+// Words are stemmed, so "games" finds "game" and "playing by mail" finds
+// "play by mail". Fields match the headers of a post instead of the body:
+//
+//	from:jane               the sender's name or address contains jane
+//	subject:diplomacy       the subject contains diplomacy
+//	before:1995-03          posted before March 1995
+//	after:1995-03-01        posted on or after March 1, 1995
+//	year:1995               posted in 1995
+//	month:1995-03           posted in March 1995
+//	author:jane@example.com sent from exactly that address
+//	thread:<ShaId>          in the thread started by the post
+//	has:references          the post refers to other posts
+//	has:replies             other posts refer to the post
+//	has:attachments         the post has attachments
+//	is:orphan               the post refers to posts that aren't in the archive
+package query
+
+import (
+	"fmt"
+	"github.com/mdhender/mbox/internal/chunk"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Node is a parsed query.
+type Node interface {
+	node()
+}
+
+// And matches documents that match every node.
+type And []Node
+
+// Or matches documents that match any node.
+type Or []Node
+
+// Not matches documents that don't match the node.
+type Not struct {
+	Node Node
+}
+
+// Term matches documents that contain the stemmed word.
+type Term struct {
+	Word string
+}
+
+// Phrase matches documents that contain the stemmed words in order.
+type Phrase struct {
+	Words   []string
+	Offsets []int // position of each word relative to the first, counting words left out
+}
+
+// Prefix matches documents that contain a stemmed word starting with
+// the prefix.
+type Prefix struct {
+	Prefix string
+}
+
+// Fuzzy matches documents that contain a stemmed word within Distance
+// edits of the stemmed word.
+type Fuzzy struct {
+	Word     string
+	Distance int
+}
+
+// Near matches documents where the words of both nodes, each a Term,
+// Phrase, Prefix, or Fuzzy, are within Distance words of each other,
+// in either order.
+type Near struct {
+	Left, Right Node
+	Distance    int
+}
+
+// Field matches documents by the headers of the post.
+type Field struct {
+	Name  string // from, subject, before, after, year, month, author, thread, has, or is
+	Value string // lower-cased, except for thread
+	Date  time.Time
+}
+
+func (And) node()    {}
+func (Or) node()     {}
+func (Not) node()    {}
+func (Term) node()   {}
+func (Phrase) node() {}
+func (Prefix) node() {}
+func (Fuzzy) node()  {}
+func (Near) node()   {}
+func (Field) node()  {}
+
+// SyntaxError is returned when a query can't be parsed.
+type SyntaxError struct {
+	Pos int // byte offset in the query
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("query: %d: %s", e.Pos, e.Msg)
+}
+
+// defaultDistance is the distance for NEAR without a number.
+const defaultDistance = 10
+
+// dateLayouts are the layouts accepted by before: and after:.
+var dateLayouts = []string{"2006-01-02", "2006/01/02", "2006-01", "2006/01", "2006"}
+
+// Parse parses a query. Words are tokenized and stemmed the same way as
+// the corpus, so words that are too short or are stop words are dropped.
+// It returns nil if nothing is left to search for.
+func Parse(input string, stopWords map[string]bool) (Node, error) {
+	p := &parser{tokens: lex(input), stopWords: stopWords, end: len(input)}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	} else if t := p.peek(); t != nil {
+		return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("unexpected %q", t.text)}
+	}
+	return n, nil
+}
+
+// token is a word, a quoted phrase, or a parenthesis.
+type token struct {
+	pos     int
+	text    string
+	quoted  bool // true if the text was quoted, so it can't be an operator
+	negated bool // true if the text started with a minus sign
+}
+
+// lex splits the input into tokens. A field name stays attached to its
+// value, quoted or not, so `subject:"play by mail"` is a single token.
+func lex(input string) []*token {
+	var tokens []*token
+	for i := 0; i < len(input); {
+		switch c := input[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, &token{pos: i, text: input[i : i+1]})
+			i++
+		default:
+			start := i
+			for i < len(input) && !strings.ContainsRune(" \t\n\r()", rune(input[i])) {
+				if input[i] != '"' {
+					i++
+					continue
+				}
+				// a quote runs to the closing quote or the end of the input
+				if end := strings.IndexByte(input[i+1:], '"'); end != -1 {
+					i += end + 2
+				} else {
+					i = len(input)
+				}
+			}
+			t := &token{pos: start, text: input[start:i]}
+			if len(t.text) > 1 && t.text[0] == '-' {
+				t.text, t.negated = t.text[1:], true
+			}
+			if unquoted := strings.ReplaceAll(t.text, `"`, ""); unquoted != t.text {
+				t.text, t.quoted = unquoted, true
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+type parser struct {
+	tokens    []*token
+	stopWords map[string]bool
+	end       int // length of the input, for errors at the end
+}
+
+func (p *parser) peek() *token {
+	if len(p.tokens) == 0 {
+		return nil
+	}
+	return p.tokens[0]
+}
+
+func (p *parser) next() *token {
+	t := p.peek()
+	if t != nil {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+// or = and { "OR" and }
+func (p *parser) or() (Node, error) {
+	var nodes Or
+	for {
+		n, err := p.and()
+		if err != nil {
+			return nil, err
+		} else if n != nil {
+			nodes = append(nodes, n)
+		}
+		if t := p.peek(); t == nil || t.quoted || t.text != "OR" {
+			break
+		}
+		p.next()
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// and = near { [ "AND" ] near }
+func (p *parser) and() (Node, error) {
+	var nodes And
+	for {
+		t := p.peek()
+		if t == nil || (!t.quoted && (t.text == ")" || t.text == "OR")) {
+			break
+		} else if !t.quoted && t.text == "AND" {
+			p.next()
+			continue
+		}
+		n, err := p.near()
+		if err != nil {
+			return nil, err
+		} else if n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, nil
+	case 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// near = unary { ( "NEAR" | "NEAR/" distance ) unary }
+//
+// A chain is split into pairs, so "a NEAR b NEAR c" needs a near b and
+// b near c. Operands that are only stop words are dropped.
+func (p *parser) near() (Node, error) {
+	n, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	operands, distances := []Node{n}, []int{}
+	for t := p.peek(); t != nil && !t.quoted && !t.negated && isNear(t.text); t = p.peek() {
+		p.next()
+		distance := defaultDistance
+		if t.text != "NEAR" {
+			if distance, err = strconv.Atoi(t.text[len("NEAR/"):]); err != nil || distance < 1 {
+				return nil, &SyntaxError{Pos: t.pos, Msg: fmt.Sprintf("%s: want a number of words like NEAR/5", t.text)}
+			}
+		}
+		if p.peek() == nil {
+			return nil, &SyntaxError{Pos: p.end, Msg: "NEAR needs words on both sides"}
+		}
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		for _, operand := range []Node{operands[len(operands)-1], n} {
+			switch operand.(type) {
+			case nil, Term, Phrase, Prefix, Fuzzy:
+			default:
+				return nil, &SyntaxError{Pos: t.pos, Msg: "NEAR needs words on both sides"}
+			}
+		}
+		operands, distances = append(operands, n), append(distances, distance)
+	}
+
+	var nodes And
+	var left Node
+	distance := 0
+	for i, n := range operands {
+		if i != 0 && distances[i-1] > distance {
+			distance = distances[i-1]
+		}
+		if n == nil {
+			continue
+		} else if left != nil {
+			nodes = append(nodes, Near{Left: left, Right: n, Distance: distance})
+		}
+		left, distance = n, 0
+	}
+	switch {
+	case len(nodes) == 0:
+		return left, nil
+	case len(nodes) == 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// isNear reports whether the text is a NEAR operator.
+func isNear(text string) bool {
+	return text == "NEAR" || strings.HasPrefix(text, "NEAR/")
+}
+
+// unary = ( "NOT" | "-" ) unary | primary
+func (p *parser) unary() (Node, error) {
+	t := p.peek()
+	if t.negated {
+		t.negated = false
+		return p.not(p.unary())
+	} else if !t.quoted && (t.text == "NOT" || t.text == "-") {
+		p.next()
+		if p.peek() == nil {
+			return nil, &SyntaxError{Pos: p.end, Msg: t.text + " needs something to negate"}
+		}
+		return p.not(p.unary())
+	}
+	return p.primary()
+}
+
+func (p *parser) not(n Node, err error) (Node, error) {
+	if err != nil || n == nil {
+		return nil, err
+	}
+	return Not{Node: n}, nil
+}
+
+// primary = "(" or ")" | field | phrase | word
+func (p *parser) primary() (Node, error) {
+	t := p.next()
+	if !t.quoted && t.text == "(" {
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		} else if closing := p.next(); closing == nil || closing.text != ")" {
+			return nil, &SyntaxError{Pos: t.pos, Msg: "missing )"}
+		}
+		return n, nil
+	} else if !t.quoted && t.text == ")" {
+		return nil, &SyntaxError{Pos: t.pos, Msg: "unexpected )"}
+	}
+	if name, value, ok := strings.Cut(t.text, ":"); ok {
+		if n, err := field(strings.ToLower(name), value); err != nil {
+			return nil, &SyntaxError{Pos: t.pos, Msg: err.Error()}
+		} else if n != nil {
+			return n, nil
+		}
+	}
+	if !t.quoted && strings.ContainsAny(t.text, "*~") {
+		n, err := p.wildcard(t.text)
+		if err != nil {
+			return nil, &SyntaxError{Pos: t.pos, Msg: err.Error()}
+		}
+		return n, nil
+	}
+	return p.words(t.text), nil
+}
+
+// minPrefix is the shortest prefix that can be searched for.
+const minPrefix = 3
+
+// wildcard returns the node for a prefix ("word*") or a fuzzy word
+// ("word~" or "word~2").
+func (p *parser) wildcard(text string) (Node, error) {
+	if prefix, ok := strings.CutSuffix(text, "*"); ok {
+		prefix = strings.ToLower(prefix)
+		if len(prefix) < minPrefix || strings.Trim(prefix, "abcdefghijklmnopqrstuvwxyz") != "" {
+			return nil, fmt.Errorf("%s: want at least %d letters before *", text, minPrefix)
+		}
+		return Prefix{Prefix: prefix}, nil
+	}
+	word, distance, _ := strings.Cut(text, "~")
+	tokens := chunk.Tokenize([]byte(word), p.stopWords)
+	if len(tokens) != 1 {
+		return nil, fmt.Errorf("%s: want a single word before ~", text)
+	}
+	f := Fuzzy{Word: string(tokens[0]), Distance: fuzziness(string(tokens[0]))}
+	if distance != "" {
+		n, err := strconv.Atoi(distance)
+		if err != nil || n < 1 || n > maxFuzziness {
+			return nil, fmt.Errorf("%s: want a number of edits from 1 to %d after ~", text, maxFuzziness)
+		}
+		f.Distance = n
+	}
+	return f, nil
+}
+
+// words returns a term for a single word and a phrase for more than one.
+func (p *parser) words(text string) Node {
+	tokens := chunk.Tokens([]byte(text), p.stopWords)
+	switch len(tokens) {
+	case 0:
+		return nil
+	case 1:
+		return Term{Word: string(tokens[0].Word)}
+	}
+	phrase := Phrase{}
+	for _, token := range tokens {
+		phrase.Words = append(phrase.Words, string(token.Word))
+		phrase.Offsets = append(phrase.Offsets, token.Pos-tokens[0].Pos)
+	}
+	return phrase
+}
+
+// field returns the node for a field, or nil if name isn't a field,
+// in which case the token is searched for as words.
+func field(name, value string) (Node, error) {
+	f := Field{Name: name, Value: strings.ToLower(strings.TrimSpace(value))}
+	switch name {
+	case "from", "subject", "author":
+		if f.Value == "" {
+			return nil, fmt.Errorf("%s: missing value", name)
+		}
+	case "thread":
+		// ShaIds are case-sensitive
+		if f.Value = strings.TrimSpace(value); f.Value == "" {
+			return nil, fmt.Errorf("%s: missing value", name)
+		}
+	case "before", "after":
+		for _, layout := range dateLayouts {
+			if t, err := time.Parse(layout, f.Value); err == nil {
+				f.Date = t
+				return f, nil
+			}
+		}
+		return nil, fmt.Errorf("%s: %q: want a date like 1995-03-01, 1995-03, or 1995", name, value)
+	case "month":
+		for _, layout := range []string{"2006-01", "2006/01"} {
+			if t, err := time.Parse(layout, f.Value); err == nil {
+				f.Date = t
+				return f, nil
+			}
+		}
+		return nil, fmt.Errorf("month: %q: want a month like 1995-03", value)
+	case "year":
+		if _, err := strconv.Atoi(f.Value); err != nil || len(f.Value) != 4 {
+			return nil, fmt.Errorf("year: %q: want a year like 1995", value)
+		}
+	case "has":
+		switch f.Value {
+		case "references", "replies", "attachments":
+		default:
+			return nil, fmt.Errorf("has: %q: want references, replies, or attachments", value)
+		}
+	case "is":
+		if f.Value != "orphan" {
+			return nil, fmt.Errorf("is: %q: want orphan", value)
+		}
+	default:
+		return nil, nil
+	}
+	return f, nil
+}
@@ -0,0 +1,469 @@
+// Package bolt implements a store that keeps the archive in an embedded
+// on-disk B+tree database, so that only the posts being viewed are held
+// in memory.
+//
+// The database has these buckets:
+//
+//	meta        version, settings, stats, stop words, and the length and Meta of each document
+//	posts       ShaId to the post without its body
+//	bodies      ShaId to the body of the post
+//	attachments ShaId and number to the attachment data
+//	ids         Message-ID to the ShaId of the canonical post
+//	days        day to the list of ShaIds posted that day
+//	periods     year or month to the period with the counts for each child
+//	authors     sender to the list of ShaIds from the sender
+//	docs        DocId to the ShaId of the post indexed as that document
+//	index       word to the posting list of the documents containing the word
+//	spellings   word to its most common spelling in the documents
+//	quarantine  sequence number to a quarantined post
+//
+// Lists of ShaIds are stored as newline-separated strings so that they
+// can be appended to without decoding them. Posting lists are stored in
+// their binary form.
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"github.com/mdhender/mbox/internal/index"
+	"github.com/mdhender/mbox/internal/lru"
+	"github.com/mdhender/mbox/internal/query"
+	"github.com/mdhender/mbox/internal/stores"
+	bbolt "go.etcd.io/bbolt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version must be incremented whenever the layout of the database changes.
+const Version = 6
+
+var (
+	metaBucket        = []byte("meta")
+	postsBucket       = []byte("posts")
+	bodiesBucket      = []byte("bodies")
+	attachmentsBucket = []byte("attachments")
+	idsBucket         = []byte("ids")
+	docsBucket        = []byte("docs")
+	daysBucket        = []byte("days")
+	periodsBucket     = []byte("periods")
+	authorsBucket     = []byte("authors")
+	indexBucket       = []byte("index")
+	spellingsBucket   = []byte("spellings")
+	quarantineBucket  = []byte("quarantine")
+
+	buckets = [][]byte{metaBucket, postsBucket, bodiesBucket, attachmentsBucket, idsBucket, docsBucket,
+		daysBucket, periodsBucket, authorsBucket, indexBucket, spellingsBucket, quarantineBucket}
+)
+
+// Store is a stores.Store backed by a bolt database.
+// Posts are cached after they are read.
+type Store struct {
+	db        *bbolt.DB
+	cache     *lru.Cache[string, *stores.Post] // posts without their bodies
+	stats     *stores.Stats
+	settings  string // hash of the settings the posts were parsed with
+	stopWords map[string]bool
+	lengths   []uint32 // number of words in each document
+	words     int      // number of words in all the documents
+	meta      []byte   // the Meta of each document; see appendMeta
+	authors   []string // the senders and threads that the Meta refer to by number
+	threads   []string
+}
+
+var _ stores.Store = (*Store)(nil)
+
+// Open opens a database created by Build for reading.
+// cacheSize is the number of posts to keep in memory.
+func Open(path string, cacheSize int) (*Store, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := &Store{db: db, cache: lru.New[string, *stores.Post](cacheSize)}
+	err = db.View(func(tx *bbolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		if meta == nil {
+			return fmt.Errorf("not a mbox database")
+		} else if version, _ := strconv.Atoi(string(meta.Get([]byte("version")))); version != Version {
+			return fmt.Errorf("database version %d: want %d", version, Version)
+		} else if err := decode(meta.Get([]byte("stats")), &s.stats); err != nil {
+			return err
+		}
+		s.settings = string(meta.Get([]byte("settings")))
+		lengths := meta.Get([]byte("lengths"))
+		for len(lengths) >= 4 {
+			s.lengths = append(s.lengths, binary.BigEndian.Uint32(lengths))
+			s.words += int(s.lengths[len(s.lengths)-1])
+			lengths = lengths[4:]
+		}
+		s.meta = append([]byte{}, meta.Get([]byte("doc-meta"))...)
+		if len(s.meta) != len(s.lengths)*metaSize {
+			return fmt.Errorf("metadata for %d documents: want %d", len(s.meta)/metaSize, len(s.lengths))
+		} else if err := decode(meta.Get([]byte("doc-authors")), &s.authors); err != nil {
+			return err
+		} else if err := decode(meta.Get([]byte("doc-threads")), &s.threads); err != nil {
+			return err
+		}
+		return decode(meta.Get([]byte("stop-words")), &s.stopWords)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Settings returns the hash of the spam and struck lists and the rewrite
+// rules the posts were parsed with, as returned by newsgroup.Settings.
+func (s *Store) Settings() string {
+	return s.settings
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Post(shaId string) (*stores.Post, error) {
+	var post *stores.Post
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		if post, err = s.post(tx, shaId); err != nil {
+			return err
+		} else if post.Missing {
+			return stores.ErrNotFound
+		}
+		body := tx.Bucket(bodiesBucket).Get([]byte(shaId))
+		// the cached post is shared, so fill in a copy
+		withBody := *post
+		withBody.Body = string(body)
+		post = &withBody
+		return nil
+	})
+	return post, err
+}
+
+func (s *Store) PostById(id string) (*stores.Post, error) {
+	var shaId string
+	_ = s.db.View(func(tx *bbolt.Tx) error {
+		shaId = string(tx.Bucket(idsBucket).Get([]byte(id)))
+		return nil
+	})
+	if shaId == "" {
+		return nil, stores.ErrNotFound
+	}
+	return s.Post(shaId)
+}
+
+func (s *Store) Attachment(shaId string, n int) (*stores.Attachment, error) {
+	var attachment *stores.Attachment
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		post, err := s.post(tx, shaId)
+		if err != nil {
+			return err
+		} else if n < 1 || n > len(post.Attachments) {
+			return stores.ErrNotFound
+		}
+		a := *post.Attachments[n-1]
+		a.Data = append([]byte{}, tx.Bucket(attachmentsBucket).Get(attachmentKey(shaId, n))...)
+		attachment = &a
+		return nil
+	})
+	return attachment, err
+}
+
+func (s *Store) Period(name string) (*stores.Period, error) {
+	var period *stores.Period
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		// days only list their posts
+		if list := tx.Bucket(daysBucket).Get([]byte(name)); list != nil {
+			period = &stores.Period{Name: name, Parent: name[:strings.LastIndexByte(name, '/')]}
+			posts, err := s.summaries(tx, list)
+			period.Posts = posts
+			return err
+		}
+		data := tx.Bucket(periodsBucket).Get([]byte(name))
+		if data == nil {
+			return stores.ErrNotFound
+		}
+		return decode(data, &period)
+	})
+	return period, err
+}
+
+func (s *Store) Author(address string) ([]*stores.Summary, error) {
+	var posts []*stores.Summary
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		list := tx.Bucket(authorsBucket).Get([]byte(address))
+		if list == nil {
+			return stores.ErrNotFound
+		}
+		var err error
+		posts, err = s.summaries(tx, list)
+		return err
+	})
+	return sortByDate(posts), err
+}
+
+func (s *Store) Thread(shaId string) ([]*stores.Summary, error) {
+	var thread []*stores.Summary
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		post, err := s.post(tx, shaId)
+		if err != nil {
+			return err
+		} else if post.Missing {
+			return stores.ErrNotFound
+		} else if post.DuplicateOf != nil {
+			shaId = post.DuplicateOf.ShaId
+		}
+		// walk the links in both directions
+		seen := map[string]bool{shaId: true}
+		queue := []string{shaId}
+		for len(queue) != 0 {
+			post, err := s.post(tx, queue[0])
+			if err != nil {
+				return err
+			}
+			queue = queue[1:]
+			if !post.Missing {
+				summary := post.Summary
+				thread = append(thread, &summary)
+			}
+			for _, links := range [][]*stores.Summary{post.References, post.ReferencedBy} {
+				for _, xref := range links {
+					if !seen[xref.ShaId] {
+						seen[xref.ShaId] = true
+						queue = append(queue, xref.ShaId)
+					}
+				}
+			}
+		}
+		return nil
+	})
+	return sortByDate(thread), err
+}
+
+func (s *Store) Search(input string, offset, limit int) (*stores.SearchResults, error) {
+	var page *stores.SearchResults
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		ix := &queryIndex{s: s, tx: tx}
+		results, hits, err := query.Search(input, s.stopWords, ix, offset, limit)
+		if err != nil {
+			return err
+		}
+		for _, hit := range hits {
+			post, err := ix.post(hit.Doc)
+			if err != nil {
+				return err
+			}
+			results.Hits = append(results.Hits, &stores.Hit{Summary: post.Summary, Score: hit.Score})
+		}
+		page = results
+		return nil
+	})
+	return page, err
+}
+
+func (s *Store) Stats() (*stores.Stats, error) {
+	stats := *s.stats
+	return &stats, nil
+}
+
+func (s *Store) Quarantine() ([]*stores.Quarantined, error) {
+	var list []*stores.Quarantined
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(quarantineBucket).ForEach(func(_, data []byte) error {
+			var q *stores.Quarantined
+			if err := decode(data, &q); err != nil {
+				return err
+			}
+			list = append(list, q)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// post returns the post without its body, from the cache if possible.
+// The result must not be changed since it is shared.
+func (s *Store) post(tx *bbolt.Tx, shaId string) (*stores.Post, error) {
+	if post, ok := s.cache.Get(shaId); ok {
+		return post, nil
+	}
+	data := tx.Bucket(postsBucket).Get([]byte(shaId))
+	if data == nil {
+		return nil, stores.ErrNotFound
+	}
+	var post *stores.Post
+	if err := decode(data, &post); err != nil {
+		return nil, err
+	}
+	s.cache.Add(shaId, post)
+	return post, nil
+}
+
+// summaries returns the summaries for a list of ShaIds.
+func (s *Store) summaries(tx *bbolt.Tx, list []byte) ([]*stores.Summary, error) {
+	var posts []*stores.Summary
+	for _, shaId := range split(list) {
+		post, err := s.post(tx, shaId)
+		if err != nil {
+			return nil, err
+		}
+		summary := post.Summary
+		posts = append(posts, &summary)
+	}
+	return posts, nil
+}
+
+// length returns the number of words in a document.
+func (s *Store) length(doc index.DocId) int {
+	return int(s.lengths[doc])
+}
+
+// queryIndex runs queries against the index in the database.
+type queryIndex struct {
+	s  *Store
+	tx *bbolt.Tx
+}
+
+func (q *queryIndex) Stats() index.Stats {
+	return index.Stats{Documents: len(q.s.lengths), Words: q.s.words, Length: q.s.length}
+}
+
+func (q *queryIndex) Lookup(word string) (*index.Postings, error) {
+	data := q.tx.Bucket(indexBucket).Get([]byte(word))
+	if data == nil {
+		return nil, nil
+	}
+	pl := &index.Postings{}
+	if err := pl.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("index: %q: %w", word, err)
+	}
+	return pl, nil
+}
+
+func (q *queryIndex) Vocabulary(prefix string) (map[string]int, error) {
+	words := make(map[string]int)
+	c := q.tx.Bucket(indexBucket).Cursor()
+	for word, data := c.Seek([]byte(prefix)); word != nil && bytes.HasPrefix(word, []byte(prefix)); word, data = c.Next() {
+		// the posting list starts with the number of documents
+		docs, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("index: %q: bad posting count", word)
+		}
+		words[string(word)] = int(docs)
+	}
+	return words, nil
+}
+
+func (q *queryIndex) Spelling(word string) (string, error) {
+	if spelling := q.tx.Bucket(spellingsBucket).Get([]byte(word)); spelling != nil {
+		return string(spelling), nil
+	}
+	return word, nil
+}
+
+// Meta is read from memory, so fields and facets don't read the posts.
+func (q *queryIndex) Meta(doc index.DocId) (*query.Meta, error) {
+	if int(doc) >= len(q.s.lengths) {
+		return nil, fmt.Errorf("document %d: %w", doc, stores.ErrNotFound)
+	}
+	data := q.s.meta[int(doc)*metaSize:]
+	n := func(i int) int {
+		return int(binary.BigEndian.Uint32(data[12+4*i:]))
+	}
+	if n(0) >= len(q.s.authors) || n(1) >= len(q.s.threads) {
+		return nil, fmt.Errorf("document %d: bad metadata", doc)
+	}
+	zone := time.FixedZone("", int(int32(binary.BigEndian.Uint32(data[8:]))))
+	return &query.Meta{
+		Author:       q.s.authors[n(0)],
+		Thread:       q.s.threads[n(1)],
+		Date:         time.Unix(int64(binary.BigEndian.Uint64(data)), 0).In(zone),
+		Attachments:  n(2),
+		References:   n(3),
+		Missing:      n(4),
+		ReferencedBy: n(5),
+	}, nil
+}
+
+func (q *queryIndex) Doc(doc index.DocId) (*query.Doc, error) {
+	m, err := q.Meta(doc)
+	if err != nil {
+		return nil, err
+	}
+	post, err := q.post(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &query.Doc{Meta: *m, From: post.From, FromAddress: post.FromAddress, Subject: post.Subject}, nil
+}
+
+// post returns the post indexed as a document.
+func (q *queryIndex) post(doc index.DocId) (*stores.Post, error) {
+	return q.s.post(q.tx, string(q.tx.Bucket(docsBucket).Get(docKey(doc))))
+}
+
+// metaSize is the size of the Meta of a document in the meta bucket.
+const metaSize = 8 + 4 + 6*4
+
+// appendMeta appends the Meta of a document: the date in Unix seconds and
+// the offset of its time zone, the numbers of the sender and the thread,
+// and the numbers of attachments, references, missing references, and
+// replies.
+func appendMeta(data []byte, m *query.Meta, author, thread int) []byte {
+	_, offset := m.Date.Zone()
+	data = binary.BigEndian.AppendUint64(data, uint64(m.Date.Unix()))
+	data = binary.BigEndian.AppendUint32(data, uint32(int32(offset)))
+	for _, n := range []int{author, thread, m.Attachments, m.References, m.Missing, m.ReferencedBy} {
+		data = binary.BigEndian.AppendUint32(data, uint32(n))
+	}
+	return data
+}
+
+func docKey(doc index.DocId) []byte {
+	return binary.BigEndian.AppendUint32(nil, uint32(doc))
+}
+
+func attachmentKey(shaId string, n int) []byte {
+	return []byte(shaId + "/" + strconv.Itoa(n))
+}
+
+// split returns the ShaIds in a list.
+func split(list []byte) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return strings.Split(string(list), "\n")
+}
+
+func encode(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(data []byte, v any) error {
+	if data == nil {
+		return fmt.Errorf("missing value")
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// sortByDate sorts the summaries oldest first, using the line number to break ties.
+func sortByDate(list []*stores.Summary) []*stores.Summary {
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].Date.Equal(list[j].Date) {
+			return list[i].Date.Before(list[j].Date)
+		}
+		return list[i].LineNo < list[j].LineNo
+	})
+	return list
+}
@@ -0,0 +1,581 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/index"
+	"github.com/mdhender/mbox/internal/query"
+	"github.com/mdhender/mbox/internal/stores"
+	"github.com/mdhender/mbox/internal/stores/newsgroup"
+	bbolt "go.etcd.io/bbolt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// batchSize is the number of posts, or words of the index, written in
+// each transaction.
+const batchSize = 1000
+
+// These buckets only exist while the database is being built.
+var (
+	hashesBucket   = []byte("hashes")   // Message-ID to the hashes of the canonical post
+	refsBucket     = []byte("refs")     // ShaId to the Message-IDs the post refers to
+	segmentsBucket = []byte("segments") // word and first DocId of a batch to its posting list
+	countsBucket   = []byte("counts")   // word and spelling to the number of times it is spelled that way
+
+	buildBuckets = [][]byte{hashesBucket, refsBucket, segmentsBucket, countsBucket}
+)
+
+// Build parses the archive at input and writes it to a new database at
+// path, replacing any database that is there once it is complete.
+// It returns the number of messages read.
+//
+// Posts are written in batches as they are parsed, so the archive never
+// has to fit in memory. The links between posts, the periods, and the
+// search index are finished by passes over the database.
+func Build(path, input string, format chunk.Format, rules *chunk.Rules, workers int) (int, error) {
+	src, err := chunk.Open(input, format)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	tmp := path + ".new"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	db, err := bbolt.Open(tmp, 0644, nil)
+	if err != nil {
+		return 0, err
+	}
+	// the database can be rebuilt if the machine crashes
+	db.NoSync = true
+	parser := newsgroup.New()
+	b := &builder{db: db, parser: parser, settings: parser.Settings(rules), stopWords: parser.Corpus.StopWords}
+	b.stats.Duplicates = make(map[string]int)
+	n, err := b.build(chunk.WithRules(src, rules), workers)
+	if err == nil {
+		err = db.Sync()
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return n, fmt.Errorf("%s: %w", path, err)
+	}
+	return n, os.Rename(tmp, path)
+}
+
+// builder writes the posts to the database a batch at a time.
+type builder struct {
+	db        *bbolt.DB
+	parser    *newsgroup.NewsGroup // parses posts without keeping them
+	settings  string               // hash of the spam and struck lists and the rules
+	stopWords map[string]bool
+	stats     stores.Stats
+	lengths   []byte            // number of words in each document, as stored in the meta bucket
+	posts     []*newsgroup.Post // the batch waiting to be written
+
+	// the Meta of each document and the senders and threads it refers to
+	meta             []byte
+	authors, threads []string
+}
+
+func (b *builder) build(src chunk.Source, workers int) (int, error) {
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range append(buckets, buildBuckets...) {
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := b.parser.Stream(src, workers, true, func(_ *chunk.Chunk, p *newsgroup.Post) error {
+		b.parser.FixDate(p)
+		if b.posts = append(b.posts, p); len(b.posts) < batchSize {
+			return nil
+		}
+		return b.flush()
+	})
+	if err != nil {
+		return n, err
+	} else if err := b.flush(); err != nil {
+		return n, err
+	} else if err := b.link(); err != nil {
+		return n, err
+	} else if err := b.addMeta(); err != nil {
+		return n, err
+	} else if err := b.putIndex(); err != nil {
+		return n, err
+	}
+
+	return n, b.db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range buildBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+		if err := b.putPeriods(tx); err != nil {
+			return err
+		}
+		meta := tx.Bucket(metaBucket)
+		for key, value := range map[string]any{"stats": &b.stats, "stop-words": b.stopWords, "doc-authors": b.authors, "doc-threads": b.threads} {
+			data, err := encode(value)
+			if err != nil {
+				return err
+			} else if err := meta.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		if err := meta.Put([]byte("lengths"), b.lengths); err != nil {
+			return err
+		} else if err := meta.Put([]byte("doc-meta"), b.meta); err != nil {
+			return err
+		} else if err := meta.Put([]byte("settings"), []byte(b.settings)); err != nil {
+			return err
+		}
+		return meta.Put([]byte("version"), []byte(strconv.Itoa(Version)))
+	})
+}
+
+// flush writes the batch of posts to the database.
+// Spam and struck posts are left out of the archive and posts with errors
+// are quarantined. The first copy of a post is the canonical one and the
+// others are recorded as its alternates. The references are saved so that
+// link can resolve them once every post has been written, and the words
+// of the batch are saved as a segment of the index.
+func (b *builder) flush() error {
+	if len(b.posts) == 0 {
+		return nil
+	}
+	err := b.db.Update(func(tx *bbolt.Tx) error {
+		r := &records{tx: tx, posts: make(map[string]*stores.Post)}
+		ids, hashes, refs := tx.Bucket(idsBucket), tx.Bucket(hashesBucket), tx.Bucket(refsBucket)
+		bodies, attachments, docs := tx.Bucket(bodiesBucket), tx.Bucket(attachmentsBucket), tx.Bucket(docsBucket)
+		days, authors := make(map[string][]string), make(map[string][]string)
+		ix, base := index.New(), index.DocId(len(b.lengths)/4)
+		for _, p := range b.posts {
+			if p.Spam || p.Struck {
+				continue
+			} else if p.Error != nil {
+				if err := b.quarantine(tx, p); err != nil {
+					return err
+				}
+				continue
+			}
+
+			post := &stores.Post{Summary: *p.Summary(), Lines: p.Lines}
+			if err := bodies.Put([]byte(post.ShaId), []byte(p.Body)); err != nil {
+				return err
+			}
+			for n, a := range p.Attachments {
+				post.Attachments = append(post.Attachments, &stores.Attachment{Name: a.Name, Type: a.Type, Size: a.Size})
+				if err := attachments.Put(attachmentKey(post.ShaId, n+1), a.Data); err != nil {
+					return err
+				}
+			}
+			r.posts[post.ShaId] = post
+
+			if shaId := ids.Get([]byte(p.Id)); shaId != nil {
+				canonical, err := r.get(string(shaId))
+				if err != nil {
+					return err
+				}
+				header, body, _ := strings.Cut(string(hashes.Get([]byte(p.Id))), "\n")
+				kind := (&newsgroup.Post{HeaderHash: header, BodyHash: body}).Compare(p)
+				post.Duplicate, post.DuplicateOf = string(kind), summary(canonical)
+				canonical.Alternates = append(canonical.Alternates, summary(post))
+				b.stats.Duplicates[string(kind)]++
+				continue
+			}
+			if err := ids.Put([]byte(p.Id), []byte(post.ShaId)); err != nil {
+				return err
+			} else if err := hashes.Put([]byte(p.Id), []byte(p.HeaderHash+"\n"+p.BodyHash)); err != nil {
+				return err
+			}
+
+			b.stats.Posts++
+			if b.stats.From.IsZero() || post.Date.Before(b.stats.From) {
+				b.stats.From = post.Date
+			}
+			if b.stats.Through.IsZero() || post.Date.After(b.stats.Through) {
+				b.stats.Through = post.Date
+			}
+			day := post.Date.Format("2006/01/02")
+			days[day] = append(days[day], post.ShaId)
+			if post.Author != "" {
+				authors[post.Author] = append(authors[post.Author], post.ShaId)
+			}
+			if len(p.References) != 0 {
+				var list []string
+				for id := range p.References {
+					list = append(list, id)
+				}
+				sort.Strings(list)
+				if err := refs.Put([]byte(post.ShaId), []byte(strings.Join(list, "\n"))); err != nil {
+					return err
+				}
+			}
+			if p.Words != nil {
+				if err := docs.Put(docKey(base+ix.Add(p.Words)), []byte(post.ShaId)); err != nil {
+					return err
+				}
+				ix.Spell(p.Spellings)
+			}
+		}
+		if err := r.put(); err != nil {
+			return err
+		}
+		for bucket, lists := range map[string]map[string][]string{"days": days, "authors": authors} {
+			if err := appendLists(tx.Bucket([]byte(bucket)), lists); err != nil {
+				return err
+			}
+		}
+		segments, counts := tx.Bucket(segmentsBucket), tx.Bucket(countsBucket)
+		for _, word := range ix.Words() {
+			data, err := ix.Lookup(word).MarshalBinary()
+			if err != nil {
+				return err
+			} else if err := segments.Put(segmentKey(word, base), data); err != nil {
+				return err
+			}
+			for spelling, n := range ix.Spellings(word) {
+				key := []byte(word + "\x00" + spelling)
+				if old := counts.Get(key); old != nil {
+					n += int(binary.BigEndian.Uint32(old))
+				}
+				if err := counts.Put(key, binary.BigEndian.AppendUint32(nil, uint32(n))); err != nil {
+					return err
+				}
+			}
+		}
+		for doc := 0; doc < ix.Len(); doc++ {
+			b.lengths = binary.BigEndian.AppendUint32(b.lengths, uint32(ix.Length(index.DocId(doc))))
+		}
+		return nil
+	})
+	b.posts = nil
+	return err
+}
+
+// quarantine records a post that had errors when it was parsed.
+func (b *builder) quarantine(tx *bbolt.Tx, p *newsgroup.Post) error {
+	log.Printf("[post] %d: %q: quarantined: %s\n", p.LineNo, p.Id, strings.ReplaceAll(p.Error.Error(), "\n", "; "))
+	data, err := encode(&stores.Quarantined{
+		LineNo:  p.LineNo,
+		Id:      p.Id,
+		From:    p.Sender,
+		Subject: p.Subject,
+		Errors:  strings.Split(p.Error.Error(), "\n"),
+	})
+	if err != nil {
+		return err
+	}
+	key := binary.BigEndian.AppendUint32(nil, uint32(b.stats.Quarantined))
+	b.stats.Quarantined++
+	return tx.Bucket(quarantineBucket).Put(key, data)
+}
+
+// link resolves the references saved by flush, a batch of posts at a time.
+// A reference to a post that isn't in the archive is linked to a
+// placeholder, which is created the first time it is referenced.
+func (b *builder) link() error {
+	var after []byte // the last post linked
+	for done := false; !done; {
+		err := b.db.Update(func(tx *bbolt.Tx) error {
+			r := &records{tx: tx, posts: make(map[string]*stores.Post)}
+			ids := tx.Bucket(idsBucket)
+			c := tx.Bucket(refsBucket).Cursor()
+			k, v := next(c, after)
+			for n := 0; k != nil && n < batchSize; k, v = c.Next() {
+				post, err := r.get(string(k))
+				if err != nil {
+					return err
+				}
+				for _, id := range split(v) {
+					var target *stores.Post
+					if shaId := ids.Get([]byte(id)); shaId != nil {
+						if target, err = r.get(string(shaId)); err != nil {
+							return err
+						}
+					} else {
+						placeholder := newsgroup.Placeholder(id, post.LineNo).Summary()
+						if target, err = r.find(placeholder.ShaId); err != nil {
+							return err
+						} else if target == nil {
+							target = &stores.Post{Summary: *placeholder}
+							r.posts[placeholder.ShaId] = target
+						}
+					}
+					post.References = append(post.References, summary(target))
+					target.ReferencedBy = append(target.ReferencedBy, summary(post))
+				}
+				after, n = append(after[:0], k...), n+1
+			}
+			done = k == nil
+			return r.put()
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMeta reads the Meta of each document from its post once the posts
+// are linked, a batch of documents at a time.
+func (b *builder) addMeta() error {
+	authors, threads := make(map[string]int), make(map[string]int)
+	number := func(numbers map[string]int, list *[]string, value string) int {
+		n, ok := numbers[value]
+		if !ok {
+			n, numbers[value] = len(*list), len(*list)
+			*list = append(*list, value)
+		}
+		return n
+	}
+	var after []byte // the last document read
+	for done := false; !done; {
+		err := b.db.View(func(tx *bbolt.Tx) error {
+			r := &records{tx: tx, posts: make(map[string]*stores.Post)}
+			c := tx.Bucket(docsBucket).Cursor()
+			k, v := next(c, after)
+			for n := 0; k != nil && n < batchSize; k, v = c.Next() {
+				post, err := r.get(string(v))
+				if err != nil {
+					return err
+				}
+				m := &query.Meta{
+					Author:       post.Author,
+					Thread:       query.Thread(post.ShaId, post.References),
+					Date:         post.Date,
+					Attachments:  len(post.Attachments),
+					References:   len(post.References),
+					ReferencedBy: len(post.ReferencedBy),
+				}
+				for _, ref := range post.References {
+					if ref.Missing {
+						m.Missing++
+					}
+				}
+				b.meta = appendMeta(b.meta, m, number(authors, &b.authors, m.Author), number(threads, &b.threads, m.Thread))
+				after, n = append(after[:0], k...), n+1
+			}
+			done = k == nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putIndex joins the segments written by flush into a posting list for
+// each word, and saves the most common spelling of the word, a batch of
+// words at a time.
+func (b *builder) putIndex() error {
+	var after []byte // the last segment joined
+	for done := false; !done; {
+		err := b.db.Update(func(tx *bbolt.Tx) error {
+			bucket, spellings := tx.Bucket(indexBucket), tx.Bucket(spellingsBucket)
+			counts := tx.Bucket(countsBucket).Cursor()
+			c := tx.Bucket(segmentsBucket).Cursor()
+			k, v := next(c, after)
+			for n := 0; k != nil && n < batchSize; n++ {
+				word := segmentWord(k)
+				pl := &index.Postings{}
+				for ; k != nil && segmentWord(k) == word; k, v = c.Next() {
+					segment := &index.Postings{}
+					if err := segment.UnmarshalBinary(v); err != nil {
+						return fmt.Errorf("index: %q: %w", word, err)
+					}
+					pl.Append(segment, index.DocId(binary.BigEndian.Uint32(k[len(k)-4:])))
+					after = append(after[:0], k...)
+				}
+				data, err := pl.MarshalBinary()
+				if err != nil {
+					return err
+				} else if err := bucket.Put([]byte(word), data); err != nil {
+					return err
+				}
+				prefix, spelled := []byte(word+"\x00"), make(map[string]int)
+				for ck, cv := counts.Seek(prefix); ck != nil && bytes.HasPrefix(ck, prefix); ck, cv = counts.Next() {
+					spelled[string(ck[len(prefix):])] = int(binary.BigEndian.Uint32(cv))
+				}
+				if err := spellings.Put([]byte(word), []byte(index.MostCommon(word, spelled))); err != nil {
+					return err
+				}
+			}
+			done = k == nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putPeriods writes the years and months with the number of posts in each child.
+func (b *builder) putPeriods(tx *bbolt.Tx) error {
+	periods := make(map[string]map[string]int)
+	count := func(name, child string, n int) {
+		if periods[name] == nil {
+			periods[name] = make(map[string]int)
+		}
+		periods[name][child] += n
+	}
+	err := tx.Bucket(daysBucket).ForEach(func(key, list []byte) error {
+		day := string(key)
+		n := len(split(list))
+		count(day[:7], day, n)
+		count(day[:4], day[:7], n)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	bucket := tx.Bucket(periodsBucket)
+	for name, children := range periods {
+		period := &stores.Period{Name: name}
+		if i := strings.LastIndexByte(name, '/'); i != -1 {
+			period.Parent = name[:i]
+		}
+		total := 0
+		for child, n := range children {
+			period.Children = append(period.Children, &stores.Count{Name: child, Count: n})
+			total += n
+		}
+		sort.Slice(period.Children, func(i, j int) bool {
+			return period.Children[i].Name < period.Children[j].Name
+		})
+		if period.Parent == "" {
+			b.stats.Years = append(b.stats.Years, &stores.Count{Name: name, Count: total})
+		}
+		data, err := encode(period)
+		if err != nil {
+			return err
+		} else if err := bucket.Put([]byte(name), data); err != nil {
+			return err
+		}
+	}
+	sort.Slice(b.stats.Years, func(i, j int) bool {
+		return b.stats.Years[i].Name < b.stats.Years[j].Name
+	})
+	return nil
+}
+
+// records holds the posts read or changed in a transaction until they are written.
+type records struct {
+	tx    *bbolt.Tx
+	posts map[string]*stores.Post
+}
+
+// find returns a post, or nil if it isn't in the database.
+func (r *records) find(shaId string) (*stores.Post, error) {
+	if post, ok := r.posts[shaId]; ok {
+		return post, nil
+	}
+	data := r.tx.Bucket(postsBucket).Get([]byte(shaId))
+	if data == nil {
+		return nil, nil
+	}
+	var post *stores.Post
+	if err := decode(data, &post); err != nil {
+		return nil, err
+	}
+	r.posts[shaId] = post
+	return post, nil
+}
+
+// get returns a post that must be in the database.
+func (r *records) get(shaId string) (*stores.Post, error) {
+	post, err := r.find(shaId)
+	if err == nil && post == nil {
+		err = fmt.Errorf("post %q: %w", shaId, stores.ErrNotFound)
+	}
+	return post, err
+}
+
+// put writes the posts with their links in date order.
+func (r *records) put() error {
+	for shaId, post := range r.posts {
+		sortByDate(post.References)
+		sortByDate(post.ReferencedBy)
+		if err := putPost(r.tx, shaId, post); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putPost writes a post without its body or attachment data.
+func putPost(tx *bbolt.Tx, shaId string, post *stores.Post) error {
+	record := *post
+	record.Body = ""
+	record.Attachments = nil
+	for _, a := range post.Attachments {
+		record.Attachments = append(record.Attachments, &stores.Attachment{Name: a.Name, Type: a.Type, Size: a.Size})
+	}
+	data, err := encode(&record)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(postsBucket).Put([]byte(shaId), data)
+}
+
+// appendLists appends ShaIds to the lists in a bucket.
+func appendLists(bucket *bbolt.Bucket, lists map[string][]string) error {
+	for key, shaIds := range lists {
+		list := []byte(strings.Join(shaIds, "\n"))
+		if old := bucket.Get([]byte(key)); old != nil {
+			list = append(append(append([]byte{}, old...), '\n'), list...)
+		}
+		if err := bucket.Put([]byte(key), list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the first entry after the key, or the first entry if key is nil.
+func next(c *bbolt.Cursor, key []byte) ([]byte, []byte) {
+	if key == nil {
+		return c.First()
+	}
+	k, v := c.Seek(key)
+	if k != nil && bytes.Equal(k, key) {
+		return c.Next()
+	}
+	return k, v
+}
+
+// segmentKey returns the key of the segment for a word in the batch of
+// documents starting at base. Words never hold a zero byte, so the
+// segments for a word sort together and in the order of their batches.
+func segmentKey(word string, base index.DocId) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(word), 0), uint32(base))
+}
+
+// segmentWord returns the word of a segment key.
+func segmentWord(key []byte) string {
+	return string(key[:len(key)-5])
+}
+
+// summary returns a copy of the summary of a post.
+func summary(post *stores.Post) *stores.Summary {
+	s := post.Summary
+	return &s
+}
@@ -0,0 +1,91 @@
+package memory
+
+import (
+	"github.com/mdhender/mbox/internal/stores"
+	"sort"
+)
+
+// Copy loads every post from another store into a new memory store.
+// The links between posts are rebuilt from the summaries.
+func Copy(src stores.Store, stopWords map[string]bool) (*Store, error) {
+	s := New(stopWords)
+
+	byShaId := make(map[string]*Message)
+	posts := make(map[*Message]*stores.Post)
+	var order []*Message
+	err := stores.Walk(src, func(post *stores.Post) error {
+		m := &Message{
+			Id:          post.Id,
+			ShaId:       post.ShaId,
+			LineNo:      post.LineNo,
+			From:        post.From,
+			FromAddress: post.FromAddress,
+			Author:      post.Author,
+			Spam:        post.Spam,
+			Struck:      post.Struck,
+			Subject:     post.Subject,
+			Date:        post.Date,
+			Lines:       post.Lines,
+			Body:        post.Body,
+			Duplicate:   post.Duplicate,
+		}
+		for n := range post.Attachments {
+			a, err := src.Attachment(post.ShaId, n+1)
+			if err != nil {
+				return err
+			}
+			m.Attachments = append(m.Attachments, a)
+		}
+		byShaId[post.ShaId], posts[m] = m, post
+		order = append(order, m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// add the posts in archive order so that they are numbered in the
+	// index as in the other stores, which ranks ties the same way
+	sort.SliceStable(order, func(i, j int) bool {
+		return order[i].LineNo < order[j].LineNo
+	})
+
+	// missing posts are only placeholders for the links
+	missing := make(map[string]*Message)
+	link := func(summary *stores.Summary) *Message {
+		if m, ok := byShaId[summary.ShaId]; ok {
+			return m
+		} else if m, ok := missing[summary.ShaId]; ok {
+			return m
+		}
+		m := &Message{Id: summary.Id, ShaId: summary.ShaId, Subject: summary.Subject, Missing: true}
+		missing[summary.ShaId] = m
+		return m
+	}
+	for _, m := range order {
+		post := posts[m]
+		for _, ref := range post.References {
+			m.References = append(m.References, link(ref))
+		}
+		for _, ref := range post.ReferencedBy {
+			m.ReferencedBy = append(m.ReferencedBy, link(ref))
+		}
+		for _, alternate := range post.Alternates {
+			m.Alternates = append(m.Alternates, link(alternate))
+		}
+		if post.DuplicateOf != nil {
+			m.DuplicateOf = link(post.DuplicateOf)
+		}
+	}
+
+	for _, m := range order {
+		s.Add(m)
+	}
+	quarantine, err := src.Quarantine()
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range quarantine {
+		s.AddQuarantined(q)
+	}
+	return s, nil
+}
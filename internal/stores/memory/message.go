@@ -1,14 +1,44 @@
 package memory
 
-import "time"
+import (
+	"github.com/mdhender/mbox/internal/stores"
+	"time"
+)
 
 type Message struct {
 	Id           string
+	ShaId        string
+	LineNo       int
+	From         string // display name of the sender
+	FromAddress  string // normalized address of the sender
+	Author       string // key for the messages from the sender
 	Spam         bool
 	Struck       bool
+	Missing      bool // true if the message is referenced but isn't in the archive
 	Subject      string
 	Date         time.Time
+	Lines        int
 	Body         string
+	Attachments  []*stores.Attachment
+	Duplicate    string   // how a duplicate copy differs from the canonical message
+	DuplicateOf  *Message // the canonical message if this is a duplicate copy
+	Alternates   []*Message
 	References   []*Message
 	ReferencedBy []*Message
+	Thread       string // ShaId of the message that started the thread, set by Add
+}
+
+// thread returns the ShaId of the oldest message that m references, or of
+// m itself if it references none. It picks the same message as query.Thread.
+func (m *Message) thread() string {
+	var oldest *Message
+	for _, ref := range m.References {
+		if oldest == nil || ref.Date.Before(oldest.Date) || ref.Date.Equal(oldest.Date) && ref.ShaId < oldest.ShaId {
+			oldest = ref
+		}
+	}
+	if oldest == nil {
+		return m.ShaId
+	}
+	return oldest.ShaId
 }
@@ -0,0 +1,346 @@
+package memory
+
+import (
+	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/index"
+	"github.com/mdhender/mbox/internal/query"
+	"github.com/mdhender/mbox/internal/stores"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Store is a stores.Store that keeps every message in memory.
+type Store struct {
+	sync.RWMutex
+	byId       map[string]*Message
+	byShaId    map[string]*Message
+	bySender   map[string][]*Message
+	periods    map[string]*period
+	index      *index.Index
+	docs       []*Message // the message for each document in the index
+	quarantine []*stores.Quarantined
+	duplicates map[string]int
+	stopWords  map[string]bool
+}
+
+// period is a year, month, or day and the messages in it.
+type period struct {
+	children map[string]bool
+	messages []*Message
+}
+
+var _ stores.Store = (*Store)(nil)
+
+// New returns an empty store.
+// The stop words are left out of the search index.
+func New(stopWords map[string]bool) *Store {
+	return &Store{
+		byId:       make(map[string]*Message),
+		byShaId:    make(map[string]*Message),
+		bySender:   make(map[string][]*Message),
+		periods:    make(map[string]*period),
+		index:      index.New(),
+		duplicates: make(map[string]int),
+		stopWords:  stopWords,
+	}
+}
+
+// Add adds a message to the store.
+// Duplicate copies can be fetched by ShaId but aren't listed or indexed.
+// Missing messages are never added; they are only referenced.
+func (s *Store) Add(m *Message) {
+	s.Lock()
+	defer s.Unlock()
+	if m.Missing {
+		return
+	}
+	s.byShaId[m.ShaId] = m
+	if m.DuplicateOf != nil {
+		s.duplicates[m.Duplicate]++
+		return
+	}
+	s.byId[m.Id] = m
+	m.Thread = m.thread()
+	if m.Author != "" {
+		s.bySender[m.Author] = append(s.bySender[m.Author], m)
+	}
+
+	// add the message to the year, month, and day
+	parent := ""
+	for _, layout := range []string{"2006", "2006/01", "2006/01/02"} {
+		name := m.Date.Format(layout)
+		p, ok := s.periods[name]
+		if !ok {
+			p = &period{children: make(map[string]bool)}
+			s.periods[name] = p
+		}
+		p.messages = append(p.messages, m)
+		if parent != "" {
+			s.periods[parent].children[name] = true
+		}
+		parent = name
+	}
+
+	if m.Spam || m.Struck {
+		return
+	}
+	words, spellings := chunk.Positions([]byte(m.Body), s.stopWords)
+	s.index.Add(words)
+	s.index.Spell(spellings)
+	s.docs = append(s.docs, m)
+}
+
+// AddQuarantined adds a post that had errors to the quarantine list.
+func (s *Store) AddQuarantined(q *stores.Quarantined) {
+	s.Lock()
+	defer s.Unlock()
+	s.quarantine = append(s.quarantine, q)
+}
+
+func (s *Store) Post(shaId string) (*stores.Post, error) {
+	s.RLock()
+	defer s.RUnlock()
+	m, ok := s.byShaId[shaId]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	return m.toStore(), nil
+}
+
+func (s *Store) PostById(id string) (*stores.Post, error) {
+	s.RLock()
+	defer s.RUnlock()
+	m, ok := s.byId[id]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	return m.toStore(), nil
+}
+
+func (s *Store) Attachment(shaId string, n int) (*stores.Attachment, error) {
+	s.RLock()
+	defer s.RUnlock()
+	m, ok := s.byShaId[shaId]
+	if !ok || n < 1 || n > len(m.Attachments) {
+		return nil, stores.ErrNotFound
+	}
+	a := *m.Attachments[n-1]
+	return &a, nil
+}
+
+func (s *Store) Period(name string) (*stores.Period, error) {
+	s.RLock()
+	defer s.RUnlock()
+	p, ok := s.periods[name]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	result := &stores.Period{Name: name}
+	if i := strings.LastIndexByte(name, '/'); i != -1 {
+		result.Parent = name[:i]
+	}
+	for child := range p.children {
+		result.Children = append(result.Children, &stores.Count{Name: child, Count: len(s.periods[child].messages)})
+	}
+	sort.Slice(result.Children, func(i, j int) bool {
+		return result.Children[i].Name < result.Children[j].Name
+	})
+	// only days list their posts
+	if len(p.children) == 0 {
+		result.Posts = summaries(p.messages)
+	}
+	return result, nil
+}
+
+func (s *Store) Author(address string) ([]*stores.Summary, error) {
+	s.RLock()
+	defer s.RUnlock()
+	messages, ok := s.bySender[address]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	return sortByDate(summaries(messages)), nil
+}
+
+func (s *Store) Thread(shaId string) ([]*stores.Summary, error) {
+	s.RLock()
+	defer s.RUnlock()
+	m, ok := s.byShaId[shaId]
+	if !ok {
+		return nil, stores.ErrNotFound
+	} else if m.DuplicateOf != nil {
+		m = m.DuplicateOf
+	}
+	// walk the links in both directions
+	seen := map[*Message]bool{m: true}
+	queue, thread := []*Message{m}, []*Message{}
+	for len(queue) != 0 {
+		m, queue = queue[0], queue[1:]
+		if !m.Missing {
+			thread = append(thread, m)
+		}
+		for _, links := range [][]*Message{m.References, m.ReferencedBy} {
+			for _, xref := range links {
+				if !seen[xref] {
+					seen[xref] = true
+					queue = append(queue, xref)
+				}
+			}
+		}
+	}
+	return sortByDate(summaries(thread)), nil
+}
+
+func (s *Store) Search(input string, offset, limit int) (*stores.SearchResults, error) {
+	s.RLock()
+	defer s.RUnlock()
+	page, hits, err := query.Search(input, s.stopWords, queryIndex{s}, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range hits {
+		page.Hits = append(page.Hits, &stores.Hit{Summary: *s.docs[hit.Doc].summary(), Score: hit.Score})
+	}
+	return page, nil
+}
+
+// queryIndex runs queries against the messages in the store.
+// The caller must hold the read lock.
+type queryIndex struct {
+	s *Store
+}
+
+func (q queryIndex) Stats() index.Stats {
+	return q.s.index.Stats()
+}
+
+func (q queryIndex) Lookup(word string) (*index.Postings, error) {
+	return q.s.index.Lookup(word), nil
+}
+
+func (q queryIndex) Vocabulary(prefix string) (map[string]int, error) {
+	return q.s.index.Vocabulary(prefix), nil
+}
+
+func (q queryIndex) Spelling(word string) (string, error) {
+	return q.s.index.Spelling(word), nil
+}
+
+func (q queryIndex) Meta(doc index.DocId) (*query.Meta, error) {
+	m := q.s.docs[doc]
+	meta := &query.Meta{
+		Author:       m.Author,
+		Thread:       m.Thread,
+		Date:         m.Date,
+		Attachments:  len(m.Attachments),
+		References:   len(m.References),
+		ReferencedBy: len(m.ReferencedBy),
+	}
+	for _, ref := range m.References {
+		if ref.Missing {
+			meta.Missing++
+		}
+	}
+	return meta, nil
+}
+
+func (q queryIndex) Doc(doc index.DocId) (*query.Doc, error) {
+	meta, err := q.Meta(doc)
+	if err != nil {
+		return nil, err
+	}
+	m := q.s.docs[doc]
+	return &query.Doc{Meta: *meta, From: m.From, FromAddress: m.FromAddress, Subject: m.Subject}, nil
+}
+
+func (s *Store) Stats() (*stores.Stats, error) {
+	s.RLock()
+	defer s.RUnlock()
+	stats := &stores.Stats{
+		Posts:       len(s.byId),
+		Quarantined: len(s.quarantine),
+		Duplicates:  make(map[string]int),
+	}
+	for _, m := range s.byId {
+		if stats.From.IsZero() || m.Date.Before(stats.From) {
+			stats.From = m.Date
+		}
+		if stats.Through.IsZero() || m.Date.After(stats.Through) {
+			stats.Through = m.Date
+		}
+	}
+	for name, p := range s.periods {
+		if len(name) == 4 {
+			stats.Years = append(stats.Years, &stores.Count{Name: name, Count: len(p.messages)})
+		}
+	}
+	sort.Slice(stats.Years, func(i, j int) bool {
+		return stats.Years[i].Name < stats.Years[j].Name
+	})
+	for kind, count := range s.duplicates {
+		stats.Duplicates[kind] = count
+	}
+	return stats, nil
+}
+
+func (s *Store) Quarantine() ([]*stores.Quarantined, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return append([]*stores.Quarantined{}, s.quarantine...), nil
+}
+
+// toStore copies the message and the summaries of the messages it links to.
+func (m *Message) toStore() *stores.Post {
+	post := &stores.Post{
+		Summary:      *m.summary(),
+		Lines:        m.Lines,
+		Body:         m.Body,
+		References:   sortByDate(summaries(m.References)),
+		ReferencedBy: sortByDate(summaries(m.ReferencedBy)),
+		Alternates:   summaries(m.Alternates),
+	}
+	for _, a := range m.Attachments {
+		post.Attachments = append(post.Attachments, &stores.Attachment{Name: a.Name, Type: a.Type, Size: a.Size})
+	}
+	if m.DuplicateOf != nil {
+		post.DuplicateOf = m.DuplicateOf.summary()
+	}
+	return post
+}
+
+func (m *Message) summary() *stores.Summary {
+	return &stores.Summary{
+		Id:          m.Id,
+		ShaId:       m.ShaId,
+		LineNo:      m.LineNo,
+		From:        m.From,
+		FromAddress: m.FromAddress,
+		Author:      m.Author,
+		Subject:     m.Subject,
+		Date:        m.Date,
+		Spam:        m.Spam,
+		Struck:      m.Struck,
+		Missing:     m.Missing,
+		Duplicate:   m.Duplicate,
+	}
+}
+
+func summaries(messages []*Message) []*stores.Summary {
+	var list []*stores.Summary
+	for _, m := range messages {
+		list = append(list, m.summary())
+	}
+	return list
+}
+
+// sortByDate sorts the summaries oldest first, using the line number to break ties.
+func sortByDate(list []*stores.Summary) []*stores.Summary {
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].Date.Equal(list[j].Date) {
+			return list[i].Date.Before(list[j].Date)
+		}
+		return list[i].LineNo < list[j].LineNo
+	})
+	return list
+}
@@ -0,0 +1,67 @@
+package newsgroup
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Address is a parsed From, Reply-To, or Sender header.
+// The same person may write "Jane <jane@x.com>" or "jane@x.com (Jane)";
+// both have the same normalized Address.
+type Address struct {
+	Name    string // display name, may be empty
+	Address string // normalized e-mail address, empty if none was found
+	Raw     string // decoded header value
+}
+
+// addressParser decodes encoded words in display names using our charsets.
+var addressParser = &mail.AddressParser{WordDecoder: wordDecoder}
+
+// reAddress finds something that looks like an address in a header
+// that net/mail couldn't parse.
+var reAddress = regexp.MustCompile(`[^\s<>()"',;:]+@[^\s<>()"',;:]+`)
+
+// parseAddress parses the value of an address header.
+// If the value holds a list, only the first address is used.
+func parseAddress(value string) Address {
+	a := Address{Raw: decodeHeader(value)}
+	if list, err := addressParser.ParseList(value); err == nil && len(list) != 0 {
+		a.Name, a.Address = list[0].Name, normalizeAddress(list[0].Address)
+		return a
+	}
+	// fall back to pulling the address out and treating the rest as the name
+	if loc := reAddress.FindStringIndex(a.Raw); loc != nil {
+		a.Address = normalizeAddress(a.Raw[loc[0]:loc[1]])
+		a.Name = strings.Trim(a.Raw[:loc[0]]+" "+a.Raw[loc[1]:], " \t<>()\"'")
+	} else {
+		a.Name = strings.TrimSpace(a.Raw)
+	}
+	return a
+}
+
+// normalizeAddress lower-cases an address and trims any punctuation
+// left over from hand-written headers.
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.Trim(address, " \t<>.,;:\"'"))
+}
+
+// Display returns the display name if there is one, otherwise the address.
+func (a Address) Display() string {
+	if a.Name != "" {
+		return a.Name
+	} else if a.Address != "" {
+		return a.Address
+	} else if a.Raw != "" {
+		return a.Raw
+	}
+	return "(missing sender)"
+}
+
+// Key returns the value used to index posts by this address.
+func (a Address) Key() string {
+	if a.Address != "" {
+		return a.Address
+	}
+	return strings.ToLower(strings.TrimSpace(a.Raw))
+}
@@ -0,0 +1,71 @@
+package newsgroup
+
+import (
+	"fmt"
+	"github.com/mdhender/mbox/internal/chunk"
+)
+
+// body returns the body of a post. If the body isn't kept in memory, it
+// is read from the archive and decoded again, and then cached.
+// The caller must hold the read lock.
+func (ng *NewsGroup) body(p *Post) (string, error) {
+	if p.Length == 0 {
+		return p.Body, nil
+	} else if ng.Bodies != nil {
+		if body, ok := ng.Bodies.Get(p.ShaId); ok {
+			return body, nil
+		}
+	}
+
+	q, err := ng.reparse(p)
+	if err != nil {
+		return "", err
+	}
+	if ng.Bodies != nil {
+		ng.Bodies.Add(p.ShaId, q.Body)
+	}
+	return q.Body, nil
+}
+
+// attachment returns the data of the nth attachment of a post, counting
+// from 1. If the body isn't kept in memory, neither is the data, so it
+// is read from the archive and decoded again. It isn't cached since
+// attachments are rarely fetched twice.
+// The caller must hold the read lock.
+func (ng *NewsGroup) attachment(p *Post, n int) ([]byte, error) {
+	if p.Length == 0 {
+		return p.Attachments[n-1].Data, nil
+	}
+	q, err := ng.reparse(p)
+	if err != nil {
+		return nil, err
+	} else if len(q.Attachments) != len(p.Attachments) {
+		return nil, fmt.Errorf("%s: line %d: message has changed since it was loaded", ng.Source.Path, p.LineNo)
+	}
+	return q.Attachments[n-1].Data, nil
+}
+
+// reparse reads the message for a post from the archive and decodes its
+// body and attachments again.
+func (ng *NewsGroup) reparse(p *Post) (*Post, error) {
+	src, err := chunk.OpenAt(ng.Source.Path, ng.Source.Format, p.Offset, p.LineNo-1)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	ch, err := src.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%s: line %d: %w", ng.Source.Path, p.LineNo, err)
+	}
+
+	// the headers that decide how the body is decoded were saved when the
+	// post was parsed, after the rules were applied
+	q := &Post{Keys: p.Keys, LineNo: p.LineNo}
+	q.hashChunk(ch)
+	if ch.Length != p.Length || q.BodyHash != p.BodyHash {
+		return nil, fmt.Errorf("%s: line %d: message has changed since it was loaded", ng.Source.Path, p.LineNo)
+	} else if err := q.ParseBody(ch); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
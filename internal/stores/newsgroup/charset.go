@@ -0,0 +1,79 @@
+package newsgroup
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// wordDecoder decodes RFC 2047 encoded words in any charset we can convert.
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := lookupCharset(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// decodeHeader decodes any RFC 2047 encoded words in a header value.
+// Raw 8-bit text that isn't valid UTF-8 is assumed to be Windows-1252.
+// If the value can't be decoded, it is returned as is.
+func decodeHeader(value string) string {
+	if decoded, err := wordDecoder.DecodeHeader(value); err == nil {
+		value = decoded
+	}
+	return string(fixUTF8([]byte(value)))
+}
+
+// toUTF8 converts text in the named charset to UTF-8.
+// Text with an unknown charset is treated like text with no charset.
+func toUTF8(charset string, data []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "us-ascii", "ascii", "utf-8", "utf8", "x-unknown", "unknown-8bit":
+		return fixUTF8(data)
+	}
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return fixUTF8(data)
+	}
+	text, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return fixUTF8(data)
+	}
+	return text
+}
+
+// fixUTF8 returns data unchanged if it is valid UTF-8.
+// Otherwise, it assumes the text is Windows-1252, which is a superset of
+// ISO-8859-1 and the most likely encoding for an old post.
+func fixUTF8(data []byte) []byte {
+	if utf8.Valid(data) {
+		return data
+	}
+	text, err := charmap.Windows1252.NewDecoder().Bytes(data)
+	if err != nil {
+		return bytes.ToValidUTF8(data, []byte("�"))
+	}
+	return text
+}
+
+// lookupCharset returns the encoding for a charset name or alias.
+func lookupCharset(charset string) (encoding.Encoding, error) {
+	charset = strings.ToLower(strings.Trim(charset, " \t\"'"))
+	if enc, err := htmlindex.Get(charset); err == nil {
+		return enc, nil
+	}
+	if enc, err := ianaindex.MIME.Encoding(charset); err == nil && enc != nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unknown charset %q", charset)
+}
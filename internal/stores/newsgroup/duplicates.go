@@ -0,0 +1,65 @@
+package newsgroup
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/mdhender/mbox/internal/chunk"
+)
+
+// Duplicate describes how a copy of a post differs from the canonical post.
+type Duplicate string
+
+const (
+	// Identical copies have the same header and body.
+	Identical Duplicate = "identical"
+	// HeaderDifferent copies have the same body but a different header,
+	// usually from being re-fed or cross-posted.
+	HeaderDifferent Duplicate = "header-different"
+	// Distinct copies have a different body; they are different posts
+	// that happen to share a Message-ID.
+	Distinct Duplicate = "distinct"
+)
+
+// hashChunk sets the hashes of the raw header and body.
+// The "From " line isn't included since every copy has its own,
+// and neither are trailing blank lines, which depend on where the
+// copy sits in the archive.
+func (p *Post) hashChunk(ch *chunk.Chunk) {
+	h := sha1.New()
+	for _, line := range ch.Header {
+		h.Write(line)
+		h.Write([]byte{'\n'})
+	}
+	p.HeaderHash = hex.EncodeToString(h.Sum(nil))
+	h.Reset()
+	body := ch.Body
+	for len(body) != 0 && len(body[len(body)-1]) == 0 {
+		body = body[:len(body)-1]
+	}
+	for _, line := range body {
+		h.Write(line)
+		h.Write([]byte{'\n'})
+	}
+	p.BodyHash = hex.EncodeToString(h.Sum(nil))
+}
+
+// Compare returns how the copy differs from the canonical post.
+func (p *Post) Compare(copy *Post) Duplicate {
+	if p.BodyHash != copy.BodyHash {
+		return Distinct
+	} else if p.HeaderHash != copy.HeaderHash {
+		return HeaderDifferent
+	}
+	return Identical
+}
+
+// addDuplicate records a post as an alternate copy of the canonical post.
+// Alternates can be viewed by their ShaId but aren't indexed or added
+// to the periods.
+func (ng *NewsGroup) addDuplicate(canonical, p *Post) {
+	p.Duplicate, p.DuplicateOf = canonical.Compare(p), canonical
+	canonical.Alternates = append(canonical.Alternates, p)
+	ng.Posts.Duplicates[p.Duplicate]++
+	ng.Posts.ByLineNo[lineNoKey(p.LineNo)] = p
+	ng.Posts.ByShaId[p.ShaId] = p
+}
@@ -0,0 +1,103 @@
+package newsgroup
+
+import (
+	"github.com/mdhender/mbox/internal/chunk"
+	"io"
+	"sync"
+)
+
+// Ingest reads every chunk from the source and adds the posts to the newsgroup.
+// The result is the same as calling Parse on each chunk in turn.
+//
+// It returns the number of chunks read and the first error from the source.
+// The caller must hold the lock if the newsgroup is being read by others.
+func (ng *NewsGroup) Ingest(src chunk.Source, workers int, createCorpus bool) (int, error) {
+	return ng.Stream(src, workers, createCorpus, func(ch *chunk.Chunk, p *Post) error {
+		ng.Add(p)
+		// remember where the message ended so that Update can start there
+		if ch.Length != 0 {
+			ng.Source.Offset, ng.Source.Line = ch.Offset+ch.Length, ch.Line+ch.Lines-1
+		}
+		return nil
+	})
+}
+
+// Stream reads every chunk from the source, parses it, and calls fn with
+// the chunk and the post in the order they were read. The posts aren't
+// added to the newsgroup, so the archive doesn't have to fit in memory.
+//
+// Splitting, parsing, and tokenizing run concurrently, with workers
+// goroutines doing the parsing. fn is only called from one goroutine.
+//
+// It returns the number of posts passed to fn and the first error from
+// the source or from fn. Once fn returns an error, it isn't called again.
+func (ng *NewsGroup) Stream(src chunk.Source, workers int, createCorpus bool, fn func(*chunk.Chunk, *Post) error) (int, error) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// a job is a chunk waiting to be parsed.
+	// the post is sent on the channel once the chunk has been parsed.
+	type job struct {
+		ch   *chunk.Chunk
+		post chan *Post
+	}
+	jobs := make(chan *job, workers*4)    // jobs waiting for a worker
+	ordered := make(chan *job, workers*4) // jobs in input order, waiting to be added
+	stop := make(chan struct{})           // closed when fn fails
+
+	// the splitter queues the jobs in input order
+	var readErr error
+	go func() {
+		defer close(jobs)
+		defer close(ordered)
+		for {
+			ch, err := src.Next()
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+			j := &job{ch: ch, post: make(chan *Post, 1)}
+			select {
+			case ordered <- j:
+			case <-stop:
+				return
+			}
+			jobs <- j
+		}
+	}()
+
+	// the workers parse the chunks
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				j.post <- ng.ParseChunk(j.ch, createCorpus)
+			}
+		}()
+	}
+
+	// pass on the posts in order, waiting for each to be parsed
+	n := 0
+	var fnErr error
+	for j := range ordered {
+		p := <-j.post
+		if fnErr != nil {
+			continue
+		} else if fnErr = fn(j.ch, p); fnErr != nil {
+			close(stop)
+			continue
+		}
+		n++
+	}
+	wg.Wait()
+
+	if fnErr != nil {
+		return n, fnErr
+	}
+	return n, readErr
+}
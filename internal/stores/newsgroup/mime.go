@@ -0,0 +1,149 @@
+package newsgroup
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Attachment is a MIME part that isn't shown as the body of the post.
+type Attachment struct {
+	Name string // file name from the part header, may be empty
+	Type string // media type of the part
+	Size int    // size of the decoded content
+	Data []byte // decoded content, nil if it is read from the archive when needed
+}
+
+// mimeBody is the result of decoding a MIME message body.
+type mimeBody struct {
+	text        string // text to display and index
+	html        string // text from the first text/html part, used if there is no text/plain part
+	attachments []*Attachment
+}
+
+// parseMIME decodes the body of a message using the Content-Type and
+// Content-Transfer-Encoding headers. The first text/plain part is used
+// as the text of the message and everything else is an attachment.
+func parseMIME(contentType, encoding string, body []byte) (text string, attachments []*Attachment, err error) {
+	mb := &mimeBody{}
+	header := textproto.MIMEHeader{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	if encoding != "" {
+		header.Set("Content-Transfer-Encoding", encoding)
+	}
+	if err := mb.addPart(header, body, 0); err != nil {
+		return "", nil, err
+	}
+	if mb.text == "" && mb.html != "" {
+		mb.text = mb.html
+	}
+	return mb.text, mb.attachments, nil
+}
+
+// maxDepth limits the nesting of multipart messages.
+const maxDepth = 10
+
+// addPart decodes a single part, recursing into multipart containers.
+func (mb *mimeBody) addPart(header textproto.MIMEHeader, body []byte, depth int) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 says to treat a missing or invalid type as plain text
+		mediaType, params = "text/plain", map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		if depth >= maxDepth {
+			return fmt.Errorf("multipart nested too deeply")
+		} else if params["boundary"] == "" {
+			return fmt.Errorf("%s: missing boundary", mediaType)
+		}
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return err
+			}
+			if err := mb.addPart(part.Header, data, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	data, err := decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	isAttachment := disposition == "attachment"
+	if !isAttachment && mediaType == "text/plain" && mb.text == "" {
+		mb.text = string(toUTF8(params["charset"], data))
+		return nil
+	} else if !isAttachment && mediaType == "text/html" && mb.html == "" {
+		mb.html = htmlToText(string(toUTF8(params["charset"], data)))
+		// keep the original so that it can be downloaded
+	}
+
+	name := dispParams["filename"]
+	if name == "" {
+		name = params["name"]
+	}
+	name = decodeHeader(name)
+	mb.attachments = append(mb.attachments, &Attachment{
+		Name: name,
+		Type: mediaType,
+		Size: len(data),
+		Data: data,
+	})
+	return nil
+}
+
+// decodeTransfer reverses the Content-Transfer-Encoding of a part.
+func decodeTransfer(encoding string, body []byte) ([]byte, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		// line breaks and any other junk outside the alphabet are ignored
+		clean := bytes.Map(func(r rune) rune {
+			if ('A' <= r && r <= 'Z') || ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') || r == '+' || r == '/' {
+				return r
+			}
+			return -1
+		}, body)
+		return base64.RawStdEncoding.DecodeString(string(clean))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	}
+	// 7bit, 8bit, binary, and anything we don't recognize
+	return body, nil
+}
+
+var (
+	reHtmlBreaks = regexp.MustCompile(`(?i)<(br|/p|/div|/li|/tr|/h[1-6])\b[^>]*>`)
+	reHtmlTags   = regexp.MustCompile(`(?s)<[^>]*>`)
+	reHtmlHidden = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)>`)
+)
+
+// htmlToText is a rough conversion of HTML to plain text for display and indexing.
+func htmlToText(s string) string {
+	s = reHtmlHidden.ReplaceAllString(s, "")
+	s = reHtmlBreaks.ReplaceAllString(s, "\n")
+	s = reHtmlTags.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
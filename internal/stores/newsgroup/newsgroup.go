@@ -2,17 +2,33 @@ package newsgroup
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
 	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/index"
+	"github.com/mdhender/mbox/internal/lru"
+	"github.com/mdhender/mbox/internal/query"
 	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
+// NewsGroup is the archive of posts.
+// Readers must hold the read lock while the archive is being updated.
 type NewsGroup struct {
+	sync.RWMutex
+	// Bodies caches the bodies of posts that are read from the archive when
+	// they are viewed. If it is nil, every body is kept in memory.
+	// It must be set before the archive is loaded.
+	Bodies *lru.Cache[string, string]
 	Corpus struct {
-		// Documents is a list of all posts with word counts
-		Documents map[string]map[string]int
-		// Index is a map of word to posts that contain the word
-		Index map[string][]*Post
+		// Index maps each word to the documents that contain it
+		Index *index.Index
+		// Posts is the post for each document in the index, by DocId
+		Posts []*Post
 		// StopWords is a list of common usenet words to exclude from the indexing.
 		StopWords map[string]bool
 	}
@@ -20,11 +36,26 @@ type NewsGroup struct {
 		ById     map[string]*Post
 		ByLineNo map[string]*Post
 		ByPeriod map[string]*Bucket
+		// BySender is the list of posts for each normalized From address
+		BySender map[string][]*Post
 		ByShaId  map[string]*Post
-		Spam     map[string]bool
-		Struck   map[string]bool
-		Years    map[string]int
+		// Duplicates is the number of alternate copies of each kind
+		Duplicates map[Duplicate]int
+		Spam       map[string]bool
+		Struck     map[string]bool
+		Years      map[string]int
+		// Count is the number of posts, not counting duplicates or missing
+		// posts, and From and Through are the dates of the oldest and newest
+		Count         int
+		From, Through time.Time
+		// Quarantine is the list of posts that had errors when parsed.
+		// They are not included in the archive.
+		Quarantine []*Post
 	}
+	// Source is the archive the posts were loaded from
+	Source Source
+	// lastDate is the date of the last post parsed, used when a post has no usable date
+	lastDate time.Time
 }
 
 type Bucket struct {
@@ -36,8 +67,7 @@ type Bucket struct {
 
 func New() *NewsGroup {
 	ng := &NewsGroup{}
-	ng.Corpus.Documents = make(map[string]map[string]int)
-	ng.Corpus.Index = make(map[string][]*Post)
+	ng.Corpus.Index = index.New()
 	ng.Corpus.StopWords = map[string]bool{
 		"a":          true,
 		"about":      true,
@@ -226,7 +256,9 @@ func New() *NewsGroup {
 	ng.Posts.ById = make(map[string]*Post)
 	ng.Posts.ByLineNo = make(map[string]*Post)
 	ng.Posts.ByShaId = make(map[string]*Post)
+	ng.Posts.Duplicates = make(map[Duplicate]int)
 	ng.Posts.ByPeriod = make(map[string]*Bucket)
+	ng.Posts.BySender = make(map[string][]*Post)
 	ng.Posts.Spam = map[string]bool{
 		"01bdec34$586dfe60$b0e00b80@hp-pavilion":                              true,
 		"01bdeca0$b784d420$27edb5cf@conquest":                                 true,
@@ -505,18 +537,41 @@ func New() *NewsGroup {
 	return ng
 }
 
+// Settings returns a hash of the spam and struck lists and the rewrite
+// rules. Posts parsed with different settings are flagged or rewritten
+// differently, so a saved copy of the archive is stale if they change.
+func (ng *NewsGroup) Settings(rules *chunk.Rules) string {
+	h := sha256.New()
+	for _, list := range []map[string]bool{ng.Posts.Spam, ng.Posts.Struck} {
+		var ids []string
+		for id, ok := range list {
+			if ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			_, _ = fmt.Fprintf(h, "%s\n", id)
+		}
+		_, _ = fmt.Fprintf(h, "\n")
+	}
+	_, _ = fmt.Fprintf(h, "%s\n", rules.Hash())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // FlagSpam will display header for suspected spam.
+// Senders are matched by normalized address.
 func (ng *NewsGroup) FlagSpam() {
 	senders := map[string]bool{
-		"HGHFGDS <fhfgfgg@gmail.com>": true,
-		"iwcwatches5@gmail.com":       true,
+		"fhfgfgg@gmail.com":     true,
+		"iwcwatches5@gmail.com": true,
 	}
 
 	for _, p := range ng.Posts.ById {
 		if p.Spam {
 			continue
 		}
-		if senders[p.Sender] {
+		if senders[p.From.Address] {
 			log.Printf("[spam] post %q\n", p.Id)
 		}
 	}
@@ -537,9 +592,11 @@ func (ng *NewsGroup) FlagStruck() {
 	}
 }
 
+// unknownSender is the sender of a placeholder for a missing post.
+const unknownSender = "** unknown sender **"
+
 // LinkPosts links referenced and referencing posts.
 func (ng *NewsGroup) LinkPosts() {
-	unknownSender := "** unknown sender **"
 	for _, p := range ng.Posts.ById {
 		for id := range p.References {
 			// when we parsed, we added a reference to the id without creating a post.
@@ -548,21 +605,8 @@ func (ng *NewsGroup) LinkPosts() {
 			xref := ng.Posts.ById[id]
 			realPost := xref != nil && xref.Sender != unknownSender
 			if xref == nil {
-				// create it
-				xref = &Post{
-					Id:           id,
-					ShaId:        sha1sum(id),
-					Body:         "This is not the original post.\nWe were unable to locate the original in the archive.\n",
-					Keys:         make(map[string][]string),
-					Lines:        5,
-					LineNo:       p.LineNo,
-					Missing:      true,
-					References:   make(map[string]*Post),
-					ReferencedBy: make(map[string]*Post),
-					Sender:       unknownSender,
-					Subject:      "** missing post **",
-				}
-				// add it to the archive
+				// create it and add it to the archive
+				xref = Placeholder(id, p.LineNo)
 				ng.Posts.ById[xref.Id] = xref
 			}
 			// update the link in our map
@@ -573,6 +617,50 @@ func (ng *NewsGroup) LinkPosts() {
 			}
 		}
 	}
+	ng.linkThreads()
+}
+
+// linkThreads sets the Thread of every post from the posts it references.
+func (ng *NewsGroup) linkThreads() {
+	for _, p := range ng.Posts.ById {
+		p.Thread = p.thread()
+	}
+}
+
+// thread returns the ShaId of the oldest post that p references, or of p
+// itself if it references none. It picks the same post as query.Thread.
+func (p *Post) thread() string {
+	var oldest *Post
+	for _, ref := range p.References {
+		if ref == nil {
+			continue
+		} else if oldest == nil || ref.Date.Before(oldest.Date) || ref.Date.Equal(oldest.Date) && ref.ShaId < oldest.ShaId {
+			oldest = ref
+		}
+	}
+	if oldest == nil {
+		return p.ShaId
+	}
+	return oldest.ShaId
+}
+
+// Placeholder returns a post that stands in for a referenced post that
+// isn't in the archive. lineNo is the line of the post that refers to it.
+func Placeholder(id string, lineNo int) *Post {
+	return &Post{
+		Id:           id,
+		ShaId:        sha1sum(id),
+		Body:         "This is not the original post.\nWe were unable to locate the original in the archive.\n",
+		Keys:         make(map[string][]string),
+		Lines:        5,
+		LineNo:       lineNo,
+		Missing:      true,
+		References:   make(map[string]*Post),
+		ReferencedBy: make(map[string]*Post),
+		From:         Address{Raw: unknownSender},
+		Sender:       unknownSender,
+		Subject:      "** missing post **",
+	}
 }
 
 func sha1sum(s string) string {
@@ -580,31 +668,78 @@ func sha1sum(s string) string {
 	return base64.RawURLEncoding.EncodeToString(sum[:])
 }
 
-func (ng *NewsGroup) SearchPosts(input string) map[string]*Post {
-	posts := make(map[string]*Post)
-	for n, word := range chunk.Tokenize([]byte(input), ng.Corpus.StopWords) {
-		// set is the set of documents containing this word
-		set := make(map[string]*Post)
-		if documents, ok := ng.Corpus.Index[string(word)]; ok {
-			for _, post := range documents {
-				set[post.ShaId] = post
-			}
-		}
-		if n == 0 {
-			posts = set
-		} else {
-			// we want the intersection of current posts and this set
-			intersection := make(map[string]*Post)
-			for _, post := range set {
-				if _, ok := posts[post.ShaId]; ok {
-					intersection[post.ShaId] = post
-				}
-			}
-			// result is the intersection
-			posts = intersection
+// Result is a post that matched a search and its BM25 score.
+type Result struct {
+	Post  *Post
+	Score float64
+}
+
+// SearchPosts returns the posts that match the query, best match first.
+// See package query for the syntax.
+func (ng *NewsGroup) SearchPosts(input string) ([]*Result, error) {
+	q, err := query.Parse(input, ng.Corpus.StopWords)
+	if err != nil {
+		return nil, err
+	} else if q, err = query.Expand(q, corpusIndex{ng}); err != nil {
+		return nil, err
+	}
+	hits, err := query.Run(q, corpusIndex{ng})
+	if err != nil {
+		return nil, err
+	}
+	var results []*Result
+	for _, hit := range hits {
+		results = append(results, &Result{Post: ng.Corpus.Posts[hit.Doc], Score: hit.Score})
+	}
+	return results, nil
+}
+
+// corpusIndex runs queries against the corpus.
+type corpusIndex struct {
+	ng *NewsGroup
+}
+
+func (c corpusIndex) Stats() index.Stats {
+	return c.ng.Corpus.Index.Stats()
+}
+
+func (c corpusIndex) Lookup(word string) (*index.Postings, error) {
+	return c.ng.Corpus.Index.Lookup(word), nil
+}
+
+func (c corpusIndex) Vocabulary(prefix string) (map[string]int, error) {
+	return c.ng.Corpus.Index.Vocabulary(prefix), nil
+}
+
+func (c corpusIndex) Spelling(word string) (string, error) {
+	return c.ng.Corpus.Index.Spelling(word), nil
+}
+
+func (c corpusIndex) Meta(doc index.DocId) (*query.Meta, error) {
+	p := c.ng.Corpus.Posts[doc]
+	m := &query.Meta{
+		Author:       p.From.Key(),
+		Date:         p.Date,
+		Attachments:  len(p.Attachments),
+		References:   len(p.References),
+		ReferencedBy: len(p.ReferencedBy),
+		Thread:       p.Thread,
+	}
+	for _, ref := range p.References {
+		if ref == nil || ref.Missing {
+			m.Missing++
 		}
 	}
-	return posts
+	return m, nil
+}
+
+func (c corpusIndex) Doc(doc index.DocId) (*query.Doc, error) {
+	m, err := c.Meta(doc)
+	if err != nil {
+		return nil, err
+	}
+	p := c.ng.Corpus.Posts[doc]
+	return &query.Doc{Meta: *m, From: p.From.Display(), FromAddress: p.From.Address, Subject: p.Subject}, nil
 }
 
 func (b *Bucket) Count() int {
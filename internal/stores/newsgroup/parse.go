@@ -1,12 +1,25 @@
 package newsgroup
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/dates"
 	"log"
+	"strings"
 )
 
-func (ng *NewsGroup) Parse(ch *chunk.Chunk, createCorpus bool) (*Post, error) {
+// Parse creates a post from a chunk and adds it to the newsgroup.
+// Errors don't stop the parse. They are saved on the post and the post
+// is added to the quarantine list instead of the archive.
+func (ng *NewsGroup) Parse(ch *chunk.Chunk, createCorpus bool) *Post {
+	return ng.Add(ng.ParseChunk(ch, createCorpus))
+}
+
+// ParseChunk creates a post from a chunk without adding it to the newsgroup.
+// It only reads from the newsgroup, so it is safe to call from many goroutines
+// as long as nothing is being added at the same time.
+func (ng *NewsGroup) ParseChunk(ch *chunk.Chunk, createCorpus bool) *Post {
 	p := &Post{
 		Keys:         make(map[string][]string),
 		LineNo:       ch.Line,
@@ -17,9 +30,13 @@ func (ng *NewsGroup) Parse(ch *chunk.Chunk, createCorpus bool) (*Post, error) {
 	}
 
 	// parse the header
-	err := p.ParseHeader(ch)
-	if err != nil {
-		return nil, fmt.Errorf("post %q: %w", string(ch.From[5:]), err)
+	if err := p.ParseHeader(ch); err != nil {
+		p.Error = err
+	}
+	p.hashChunk(ch)
+	// fall back to other headers if there's no usable date
+	if p.Date.IsZero() {
+		p.findDate()
 	}
 
 	if p.Id == "" {
@@ -38,21 +55,66 @@ func (ng *NewsGroup) Parse(ch *chunk.Chunk, createCorpus bool) (*Post, error) {
 	}
 
 	// parse the body
-	err = p.ParseBody(ch)
-	if err != nil {
-		return nil, fmt.Errorf("post %q: %w", string(ch.From[5:]), err)
+	if err := p.ParseBody(ch); err != nil {
+		p.Error = errors.Join(p.Error, err)
+	}
+	// don't index if spam or struck
+	if p.Spam || p.Struck {
+		return p
+	}
+
+	if createCorpus {
+		p.Words, p.Spellings = chunk.Positions([]byte(p.Body), ng.Corpus.StopWords)
 	}
+
+	// drop the body and the attachment data if they can be read from the
+	// archive when they are viewed
+	if ng.Bodies != nil && ch.Length != 0 && !ng.Source.Compressed {
+		p.Offset, p.Length, p.Body = ch.Offset, ch.Length, ""
+		for _, a := range p.Attachments {
+			a.Data = nil
+		}
+	}
+
+	return p
+}
+
+// lineNoKey returns the key for a post in ByLineNo.
+func lineNoKey(lineNo int) string {
+	return fmt.Sprintf("%d", lineNo)
+}
+
+// Add adds a parsed post to the newsgroup.
+// Posts must be added in the order they appear in the archive since a
+// post without a date is given the date of the post before it.
+func (ng *NewsGroup) Add(p *Post) *Post {
+	ng.FixDate(p)
+
 	// don't index if spam or struck
 	if p.Spam || p.Struck {
-		return p, nil
+		return p
+	}
+
+	if p.Error != nil {
+		log.Printf("[post] %d: %q: quarantined: %s\n", p.LineNo, p.Id, strings.ReplaceAll(p.Error.Error(), "\n", "; "))
+		ng.Posts.Quarantine = append(ng.Posts.Quarantine, p)
+		return p
 	}
 
-	if ng.Posts.ById[p.Id] != nil {
-		return nil, fmt.Errorf("post %q: duplicate id %q", string(ch.From[5:]), p.Id)
+	// keep the first copy of a post and record the others as alternates.
+	// a post that was missing when the posts were linked replaces its placeholder.
+	if canonical := ng.Posts.ById[p.Id]; canonical != nil && !canonical.Missing {
+		ng.addDuplicate(canonical, p)
+		return p
 	}
 	ng.Posts.ById[p.Id] = p
-	ng.Posts.ByLineNo[fmt.Sprintf("%d", p.LineNo)] = p
+	ng.Posts.ByLineNo[lineNoKey(p.LineNo)] = p
 	ng.Posts.ByShaId[p.ShaId] = p
+	if sender := p.From.Key(); sender != "" {
+		ng.Posts.BySender[sender] = append(ng.Posts.BySender[sender], p)
+	}
+
+	ng.count(p)
 
 	// add this post to all the buckets
 	year := p.Date.Format("2006")
@@ -94,12 +156,48 @@ func (ng *NewsGroup) Parse(ch *chunk.Chunk, createCorpus bool) (*Post, error) {
 	dayBucket.Posts = append(dayBucket.Posts, p)
 	p.Up = "/from/" + yearMonth
 
-	if createCorpus {
-		p.Words = ch.Words(ng.Corpus.StopWords)
-		for word := range p.Words {
-			ng.Corpus.Index[word] = append(ng.Corpus.Index[word], p)
-		}
+	if p.Words != nil {
+		ng.Corpus.Index.Add(p.Words)
+		ng.Corpus.Index.Spell(p.Spellings)
+		ng.Corpus.Posts = append(ng.Corpus.Posts, p)
+		// the counts are kept in the index
+		p.Words, p.Spellings = nil, nil
 	}
 
-	return p, nil
+	return p
+}
+
+// count adds the post to the number of posts and the range of their dates.
+func (ng *NewsGroup) count(p *Post) {
+	ng.Posts.Count++
+	if ng.Posts.From.IsZero() || p.Date.Before(ng.Posts.From) {
+		ng.Posts.From = p.Date
+	}
+	if ng.Posts.Through.IsZero() || p.Date.After(ng.Posts.Through) {
+		ng.Posts.Through = p.Date
+	}
+}
+
+// FixDate gives a post without a usable date the date of the post before
+// it, or quarantines the post if there isn't one. Add calls it, so it is
+// only needed for posts that aren't added. Posts must be passed in the
+// order they appear in the archive.
+func (ng *NewsGroup) FixDate(p *Post) {
+	if p.Date.IsZero() {
+		if ng.lastDate.IsZero() {
+			if p.DateError == nil {
+				p.DateError = fmt.Errorf("missing date")
+			}
+			p.Error = errors.Join(p.Error, p.DateError)
+		} else {
+			p.Date, p.DateSource = ng.lastDate, dates.Neighbour
+		}
+	}
+	switch p.DateSource {
+	case dates.Posted, dates.Received, dates.Neighbour:
+		log.Printf("[post] %d: no usable date header: using %s date\n", p.LineNo, p.DateSource)
+	}
+	if !p.Date.IsZero() {
+		ng.lastDate = p.Date
+	}
 }
@@ -1,8 +1,10 @@
 package newsgroup
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/dates"
 	"log"
 	"strings"
 	"time"
@@ -10,23 +12,38 @@ import (
 
 // Post is a single posting to the newsgroup
 type Post struct {
-	Id           string              // unique ID from the "From " block header
-	ShaId        string              // SHA-1 hash of the Id
-	Body         string              // body of the posting
-	Date         time.Time           // time post was added to the newsgroup
-	Error        error               // any error parsing the message
-	Keys         map[string][]string // unknown (or ignored) keys and values
-	Lines        int                 // number of lines in post body
-	LineNo       int                 // line number from original mbox file
-	Missing      bool                // true if the original message is missing
-	References   map[string]*Post    // posts this post references
-	ReferencedBy map[string]*Post    // posts referring to this post
-	Sender       string              // e-mail address of person sending the post
-	Spam         bool                // post is considered spam
-	Struck       bool                // post is struck for copyright or ownership
-	Subject      string              // subject of post
-	Words        map[string]int      // word frequency for corpus
-	Up           string              // link to parent topic or period
+	Id           string                    // unique ID from the "From " block header
+	ShaId        string                    // SHA-1 hash of the Id
+	Alternates   []*Post                   // other copies of this post found in the archive
+	Attachments  []*Attachment             // MIME parts that aren't part of the body
+	Body         string                    // body of the posting, empty if it is read from the archive when needed
+	BodyHash     string                    // SHA-1 hash of the raw body
+	Date         time.Time                 // time post was added to the newsgroup
+	DateError    error                     // error parsing the Date header, if any
+	DateSource   dates.Strategy            // how the date was found
+	Duplicate    Duplicate                 // how this copy differs from the canonical post
+	DuplicateOf  *Post                     // the canonical post if this is a duplicate
+	Error        error                     // any error parsing the message
+	From         Address                   // parsed From header
+	HeaderHash   string                    // SHA-1 hash of the raw header
+	Keys         map[string][]string       // unknown (or ignored) keys and values
+	Lines        int                       // number of lines in post body
+	LineNo       int                       // line number from original mbox file
+	Length       int64                     // length of the message in the archive, zero if the body is kept in memory
+	Missing      bool                      // true if the original message is missing
+	Offset       int64                     // byte offset of the message in the archive
+	References   map[string]*Post          // posts this post references
+	ReferencedBy map[string]*Post          // posts referring to this post
+	ReplyTo      Address                   // parsed Reply-To header
+	Sender       string                    // From header of the post, as found in the post
+	SentBy       Address                   // parsed Sender header
+	Spam         bool                      // post is considered spam
+	Spellings    map[string]map[string]int // how often each word is spelled each way, cleared with Words
+	Struck       bool                      // post is struck for copyright or ownership
+	Subject      string                    // subject of post
+	Thread       string                    // ShaId of the post that started the thread, set by LinkPosts
+	Words        map[string][]int          // word positions for corpus, cleared once the post is indexed
+	Up           string                    // link to parent topic or period
 }
 
 // ParseBody populates body from the input Chunk.
@@ -47,16 +64,62 @@ func (p *Post) ParseBody(ch *chunk.Chunk) error {
 		sb.WriteByte('\n')
 	}
 	p.Lines, p.Body = len(ch.Body)+2, sb.String()
+
+	// decode MIME messages, keeping the raw body if that fails
+	contentType, encoding := p.header("content-type"), p.header("content-transfer-encoding")
+	if p.header("mime-version") == "" && contentType == "" && encoding == "" {
+		p.Body = string(fixUTF8([]byte(p.Body)))
+		return nil
+	}
+	text, attachments, err := parseMIME(contentType, encoding, []byte(p.Body))
+	if err != nil {
+		log.Printf("[post] %d: mime: %v\n", p.LineNo, err)
+		p.Body = string(fixUTF8([]byte(p.Body)))
+		return nil
+	}
+	p.Lines, p.Body, p.Attachments = strings.Count(text, "\n")+2, text, attachments
 	return nil
 }
 
+// findDate looks for the date of the post in the NNTP-Posting-Date and
+// Received headers when the Date header is missing or can't be parsed.
+// It returns false if neither header has a usable date.
+func (p *Post) findDate() bool {
+	for _, value := range p.Keys["nntp-posting-date"] {
+		if t, _, err := dates.Parse(value); err == nil {
+			p.Date, p.DateSource = t, dates.Posted
+			return true
+		}
+	}
+	// the last Received header was added by the first server to see the post
+	received := p.Keys["received"]
+	for n := len(received) - 1; n >= 0; n-- {
+		if t, err := dates.ParseReceived(received[n]); err == nil {
+			p.Date, p.DateSource = t, dates.Received
+			return true
+		}
+	}
+	return false
+}
+
+// header returns the first value for a key that was saved in Keys.
+func (p *Post) header(key string) string {
+	if values := p.Keys[key]; len(values) != 0 {
+		return values[0]
+	}
+	return ""
+}
+
 // ParseHeader updates header values from the input Chunk.
+// It doesn't stop at a bad header line; it returns all the errors found.
 func (p *Post) ParseHeader(ch *chunk.Chunk) error {
 	debug := false // bytes.Equal(ch.From, []byte("From -3534941848242442294"))
+	var errs []error
 	for _, text := range ch.Header {
 		key, value, found := strings.Cut(string(text), ":")
 		if !found {
-			return fmt.Errorf("invalid header line")
+			errs = append(errs, fmt.Errorf("invalid header line %q", string(text)))
+			continue
 		}
 		key, value = strings.ToLower(key), strings.TrimSpace(value)
 		if debug {
@@ -64,86 +127,27 @@ func (p *Post) ParseHeader(ch *chunk.Chunk) error {
 		}
 		switch key {
 		case "date":
-			for _, layout := range []string{
-				//	"Thu, 24 Mar 2011 20:09:09 -0700 (PDT)"
-				"Mon, 2 Jan 2006 15:04:05 -0700 (MST)",
-				// "09 Oct 2007 02:46:48 GMT"
-				"02 Jan 2006 15:04:05 MST",
-				// "10 May 2011 12:36:45 GMT"
-				"2 Jan 2006 15:04:05 MST",
-				// "02 Aug 2003 00:26:31 +0200"
-				"02 Jan 2006 15:04:05 -0700",
-				// "10 May 2011 08:53:15 -0400"
-				"2 Jan 2006 15:04:05 -0700",
-				// "Mon, 05 Jan 2009 13:44:02 -0600"
-				"Mon, 02 Jan 2006 15:04:05 -0700",
-				// "Tue, 4 Sep 2012 20:37:24 +0200"
-				"Mon, 2 Jan 2006 15:04:05 -0700",
-				// "Wed, 7 Jan 2009 07:26:42 GMT"
-				"Mon, 02 Jan 2006 15:04:05 MST",
-				// "Sun, 28 Dec 2008 22:43:09 GMT"
-				"Mon, 2 Jan 2006 15:04:05 MST",
-				// "15 Feb 01 17:44:09 GMT"
-				"2 Jan 06 15:04:05 MST",
-				// "Sat, 17 Feb 01 23:14:55"
-				"Mon, 2 Jan 06 15:04:05",
-				// "15 Dec 00 15:28:22 +0100"
-				"2 Jan 06 15:04:05 -0700",
-				// "2000/11/28"
-				"2006/01/02",
-				// "25 Mar 95 19:26:17"
-				"2 Jan 06 15:04:05",
-				// "Sat, 25 Mar 95 22:34:21 -0500"
-				"Mon, 2 Jan 06 15:04:05 -0700",
-				// "Mon, 27 Mar 1995 14:54:12"
-				"Mon, 2 Jan 2006 15:04:05",
-				// "Sat, 18 Mar 95 21:05:28 PDT"
-				"Mon, 2 Jan 06 15:04:05 MST",
-				// "Sun, 19 Mar 1995 08:37:28 LOCAL"
-				"Mon, 2 Jan 2006 15:04:05 LOCAL",
-				// "Sat, 11 Mar 1995 12:17:31 UNDEFINED"
-				"Mon, 2 Jan 2006 15:04:05 UNDEFINED",
-				// "5 Feb 1995 11:01 -0500"
-				"2 Jan 2006 15:04 -0700",
-				// "Thu, 12 Jan 1995 23:01"
-				"Mon, 2 Jan 2006 15:05",
-				// "17 Dec 1994 01:04 CST"
-				"2 Jan 2006 15:04 MST",
-				// "12 Oct 94 16:11:03 +"
-				"2 Jan 06 15:04:05 +",
-				// "Wed, 12 Oct 1994 09:35:51 Central"
-				//"Mon, 2 Jan 2006 15:04:05 Central",
-				// "Tue, 31 May 1994  13:46 MET"
-				"Mon, 2 Jan 2006  15:04 MST",
-				// "Mon, 23 May 94 15:51:27 -0700 (PDT)"
-				"Mon, 2 Jan 06 15:04:05 -0700 (MST)",
-				// "Thu, 02 Dec 93 19:50:54 est"
-				"Mon, 02 Jan 06 15:04:05 MST",
-				// "Monday, 12 Jul 1993 14:46:15 EDT"
-				"Monday, 2 Jan 2006 15:04:05 MST",
-			} {
-				if t, err := time.Parse(layout, value); err == nil {
-					//if op := t.Format(layout); op != h.Date {
-					//	if h.Date != strings.Replace(op, "+0000", "-0000", 1) {
-					//		log.Printf("%d\n  fmt %q\nvalue %q\n   op %q\n", n+1, layout, h.Date, op)
-					//	}
-					//}
-					p.Date = t.UTC()
-					break
-				}
-			}
-			if p.Date.IsZero() {
-				return fmt.Errorf("unknown layout %q", value)
+			t, strategy, err := dates.Parse(value)
+			if err != nil {
+				// we'll look for the date in other headers later
+				p.DateError = err
+				continue
 			}
+			p.Date, p.DateSource = t, strategy
 		case "from":
-			p.Sender = value
+			p.From = parseAddress(value)
+			p.Sender = p.From.Raw
+		case "reply-to":
+			p.ReplyTo = parseAddress(value)
+		case "sender":
+			p.SentBy = parseAddress(value)
 		case "message-id":
 			if strings.HasPrefix(value, "<") && strings.HasSuffix(value, ">") {
 				p.Id = value[1 : len(value)-1]
 			} else if strings.HasPrefix(value, "<") && strings.HasSuffix(value, ">#1/1") {
 				p.Id = value[1 : len(value)-5]
 			} else {
-				return fmt.Errorf("invalid message-id %q", value)
+				errs = append(errs, fmt.Errorf("invalid message-id %q", value))
 			}
 		case "references":
 			for _, id := range strings.Fields(strings.ReplaceAll(strings.ReplaceAll(strings.ReplaceAll(value, "<", " "), ">", " "), "}", " ")) {
@@ -153,11 +157,11 @@ func (p *Post) ParseHeader(ch *chunk.Chunk) error {
 				p.References[id] = nil
 			}
 		case "subject":
-			p.Subject = value
+			p.Subject = decodeHeader(value)
 		default:
 			p.Keys[key] = append(p.Keys[key], value)
 		}
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
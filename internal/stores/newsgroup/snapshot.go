@@ -0,0 +1,448 @@
+package newsgroup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/dates"
+	"github.com/mdhender/mbox/internal/index"
+	"io"
+	"os"
+	"time"
+)
+
+// A snapshot file starts with a magic string, the version of the format,
+// and a SHA-256 checksum of the rest of the file, which is the gob
+// encoding of the newsgroup.
+//
+// Posts link to each other, so they are stored in a single list and
+// every link is replaced by the index of the post in the list.
+
+// snapshotMagic identifies a snapshot file.
+var snapshotMagic = []byte("MBOXSNAP")
+
+// SnapshotVersion must be incremented whenever the snapshot format changes.
+// Snapshots with a different version are rejected.
+const SnapshotVersion = 8
+
+type snapshot struct {
+	Source     snapshotSource
+	LastDate   time.Time
+	Posts      []*snapshotPost
+	ById       map[string]int
+	ByLineNo   map[string]int
+	ByPeriod   map[string]*snapshotBucket
+	BySender   map[string][]int
+	ByShaId    map[string]int
+	Duplicates map[Duplicate]int
+	Years      map[string]int
+	Quarantine []int
+	Index      *index.Index
+	Documents  []int // the post for each document in the index
+}
+
+type snapshotSource struct {
+	Path       string
+	Format     string
+	Offset     int64
+	Line       int
+	Compressed bool
+	ModTime    time.Time
+	Tail       string
+	Settings   string
+	Pending    int64
+}
+
+type snapshotBucket struct {
+	Parent     string
+	Period     string
+	SubPeriods []string
+	Posts      []int
+}
+
+type snapshotPost struct {
+	Id           string
+	ShaId        string
+	Alternates   []int
+	Attachments  []*Attachment
+	Body         string
+	BodyHash     string
+	Date         time.Time
+	DateError    string
+	DateSource   dates.Strategy
+	Duplicate    Duplicate
+	DuplicateOf  int
+	Error        string
+	From         Address
+	HeaderHash   string
+	Keys         map[string][]string
+	Lines        int
+	LineNo       int
+	Length       int64
+	Missing      bool
+	Offset       int64
+	References   map[string]int
+	ReferencedBy map[string]int
+	ReplyTo      Address
+	Sender       string
+	SentBy       Address
+	Spam         bool
+	Struck       bool
+	Subject      string
+	Up           string
+}
+
+// WriteSnapshot saves the newsgroup to a file.
+// The file is written to a temporary file first and then renamed,
+// so a reader never sees a partial snapshot.
+func (ng *NewsGroup) WriteSnapshot(path string) error {
+	// the snapshot shares maps and the index with the newsgroup,
+	// so it must be encoded before the lock is released
+	payload := &bytes.Buffer{}
+	ng.RLock()
+	err := gob.NewEncoder(payload).Encode(ng.snapshot())
+	ng.RUnlock()
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	checksum := sha256.Sum256(payload.Bytes())
+
+	tmp := path + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fd)
+	_, _ = w.Write(snapshotMagic)
+	_ = binary.Write(w, binary.BigEndian, uint32(SnapshotVersion))
+	_, _ = w.Write(checksum[:])
+	_, _ = w.Write(payload.Bytes())
+	if err := w.Flush(); err != nil {
+		fd.Close()
+		return err
+	} else if err := fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadSnapshot loads a newsgroup from a snapshot file.
+// It returns an error if the file isn't a snapshot, was written by a
+// different version, or is corrupt.
+func ReadSnapshot(path string) (*NewsGroup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := len(snapshotMagic) + 4 + sha256.Size
+	if len(data) < header || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return nil, fmt.Errorf("%s: not a snapshot", path)
+	}
+	if version := binary.BigEndian.Uint32(data[len(snapshotMagic):]); version != SnapshotVersion {
+		return nil, fmt.Errorf("%s: snapshot version %d: want %d", path, version, SnapshotVersion)
+	}
+	payload := data[header:]
+	if checksum := sha256.Sum256(payload); !bytes.Equal(checksum[:], data[header-sha256.Size:header]) {
+		return nil, fmt.Errorf("%s: snapshot checksum does not match", path)
+	}
+
+	var s snapshot
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&s); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	ng, err := s.restore()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return ng, nil
+}
+
+// snapshot flattens the newsgroup.
+func (ng *NewsGroup) snapshot() *snapshot {
+	s := &snapshot{
+		Source: snapshotSource{
+			Path:       ng.Source.Path,
+			Offset:     ng.Source.Offset,
+			Line:       ng.Source.Line,
+			Compressed: ng.Source.Compressed,
+			ModTime:    ng.Source.ModTime,
+			Tail:       ng.Source.Tail,
+			Settings:   ng.Source.Settings,
+			Pending:    ng.Source.Pending,
+		},
+		LastDate:   ng.lastDate,
+		ById:       make(map[string]int),
+		ByLineNo:   make(map[string]int),
+		ByPeriod:   make(map[string]*snapshotBucket),
+		BySender:   make(map[string][]int),
+		ByShaId:    make(map[string]int),
+		Duplicates: ng.Posts.Duplicates,
+		Years:      ng.Posts.Years,
+		Index:      ng.Corpus.Index,
+	}
+	if ng.Source.Format != nil {
+		s.Source.Format = ng.Source.Format.Name()
+	}
+
+	// posts are numbered as they are found
+	numbers := make(map[*Post]int)
+	var posts []*Post
+	number := func(p *Post) int {
+		if p == nil {
+			return -1
+		} else if n, ok := numbers[p]; ok {
+			return n
+		}
+		numbers[p] = len(posts)
+		posts = append(posts, p)
+		return numbers[p]
+	}
+	numberAll := func(list []*Post) []int {
+		var ns []int
+		for _, p := range list {
+			ns = append(ns, number(p))
+		}
+		return ns
+	}
+
+	for id, p := range ng.Posts.ById {
+		s.ById[id] = number(p)
+	}
+	for key, p := range ng.Posts.ByLineNo {
+		s.ByLineNo[key] = number(p)
+	}
+	for key, p := range ng.Posts.ByShaId {
+		s.ByShaId[key] = number(p)
+	}
+	for sender, list := range ng.Posts.BySender {
+		s.BySender[sender] = numberAll(list)
+	}
+	for period, b := range ng.Posts.ByPeriod {
+		sb := &snapshotBucket{Parent: b.Parent, Period: b.Period, Posts: numberAll(b.Posts)}
+		for key := range b.SubPeriods {
+			sb.SubPeriods = append(sb.SubPeriods, key)
+		}
+		s.ByPeriod[period] = sb
+	}
+	s.Quarantine = numberAll(ng.Posts.Quarantine)
+	s.Documents = numberAll(ng.Corpus.Posts)
+
+	// flattening a post may find more posts, so the list grows as we go
+	for i := 0; i < len(posts); i++ {
+		p := posts[i]
+		sp := &snapshotPost{
+			Id:           p.Id,
+			ShaId:        p.ShaId,
+			Alternates:   numberAll(p.Alternates),
+			Attachments:  p.Attachments,
+			Body:         p.Body,
+			BodyHash:     p.BodyHash,
+			Date:         p.Date,
+			DateSource:   p.DateSource,
+			Duplicate:    p.Duplicate,
+			DuplicateOf:  number(p.DuplicateOf),
+			From:         p.From,
+			HeaderHash:   p.HeaderHash,
+			Keys:         p.Keys,
+			Lines:        p.Lines,
+			LineNo:       p.LineNo,
+			Length:       p.Length,
+			Missing:      p.Missing,
+			Offset:       p.Offset,
+			References:   make(map[string]int),
+			ReferencedBy: make(map[string]int),
+			ReplyTo:      p.ReplyTo,
+			Sender:       p.Sender,
+			SentBy:       p.SentBy,
+			Spam:         p.Spam,
+			Struck:       p.Struck,
+			Subject:      p.Subject,
+			Up:           p.Up,
+		}
+		if p.DateError != nil {
+			sp.DateError = p.DateError.Error()
+		}
+		if p.Error != nil {
+			sp.Error = p.Error.Error()
+		}
+		for id, ref := range p.References {
+			sp.References[id] = number(ref)
+		}
+		for id, ref := range p.ReferencedBy {
+			sp.ReferencedBy[id] = number(ref)
+		}
+		s.Posts = append(s.Posts, sp)
+	}
+
+	return s
+}
+
+// restore rebuilds the newsgroup from a snapshot.
+func (s *snapshot) restore() (*NewsGroup, error) {
+	ng := New()
+	format, err := chunk.FormatByName(s.Source.Format)
+	if err != nil {
+		return nil, err
+	}
+	ng.Source = Source{
+		Path:       s.Source.Path,
+		Format:     format,
+		Offset:     s.Source.Offset,
+		Line:       s.Source.Line,
+		Compressed: s.Source.Compressed,
+		ModTime:    s.Source.ModTime,
+		Tail:       s.Source.Tail,
+		Settings:   s.Source.Settings,
+		Pending:    s.Source.Pending,
+	}
+	ng.lastDate = s.LastDate
+
+	posts := make([]*Post, len(s.Posts))
+	for i := range s.Posts {
+		posts[i] = &Post{}
+	}
+	post := func(n int) (*Post, error) {
+		if n == -1 {
+			return nil, nil
+		} else if n < 0 || n >= len(posts) {
+			return nil, fmt.Errorf("snapshot: post %d out of range", n)
+		}
+		return posts[n], nil
+	}
+	postList := func(ns []int) ([]*Post, error) {
+		var list []*Post
+		for _, n := range ns {
+			p, err := post(n)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, p)
+		}
+		return list, nil
+	}
+
+	for i, sp := range s.Posts {
+		p := posts[i]
+		*p = Post{
+			Id:           sp.Id,
+			ShaId:        sp.ShaId,
+			Attachments:  sp.Attachments,
+			Body:         sp.Body,
+			BodyHash:     sp.BodyHash,
+			Date:         sp.Date,
+			DateSource:   sp.DateSource,
+			Duplicate:    sp.Duplicate,
+			From:         sp.From,
+			HeaderHash:   sp.HeaderHash,
+			Keys:         sp.Keys,
+			Lines:        sp.Lines,
+			LineNo:       sp.LineNo,
+			Length:       sp.Length,
+			Missing:      sp.Missing,
+			Offset:       sp.Offset,
+			References:   make(map[string]*Post),
+			ReferencedBy: make(map[string]*Post),
+			ReplyTo:      sp.ReplyTo,
+			Sender:       sp.Sender,
+			SentBy:       sp.SentBy,
+			Spam:         sp.Spam,
+			Struck:       sp.Struck,
+			Subject:      sp.Subject,
+			Up:           sp.Up,
+		}
+		if p.Keys == nil {
+			p.Keys = make(map[string][]string)
+		}
+		if sp.DateError != "" {
+			p.DateError = errors.New(sp.DateError)
+		}
+		if sp.Error != "" {
+			p.Error = errors.New(sp.Error)
+		}
+		if p.Alternates, err = postList(sp.Alternates); err != nil {
+			return nil, err
+		} else if p.DuplicateOf, err = post(sp.DuplicateOf); err != nil {
+			return nil, err
+		}
+		for id, n := range sp.References {
+			if p.References[id], err = post(n); err != nil {
+				return nil, err
+			}
+		}
+		for id, n := range sp.ReferencedBy {
+			if p.ReferencedBy[id], err = post(n); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for id, n := range s.ById {
+		if ng.Posts.ById[id], err = post(n); err != nil {
+			return nil, err
+		}
+	}
+	for key, n := range s.ByLineNo {
+		if ng.Posts.ByLineNo[key], err = post(n); err != nil {
+			return nil, err
+		}
+	}
+	for key, n := range s.ByShaId {
+		if ng.Posts.ByShaId[key], err = post(n); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range ng.Posts.ByShaId {
+		// duplicate copies are listed too, but aren't counted
+		if !p.Missing && p.DuplicateOf == nil {
+			ng.count(p)
+		}
+	}
+	for sender, ns := range s.BySender {
+		if ng.Posts.BySender[sender], err = postList(ns); err != nil {
+			return nil, err
+		}
+	}
+	for period, sb := range s.ByPeriod {
+		b := &Bucket{Parent: sb.Parent, Period: sb.Period, SubPeriods: make(map[string]*Bucket)}
+		if b.Posts, err = postList(sb.Posts); err != nil {
+			return nil, err
+		}
+		ng.Posts.ByPeriod[period] = b
+	}
+	for period, sb := range s.ByPeriod {
+		for _, key := range sb.SubPeriods {
+			sub, ok := ng.Posts.ByPeriod[key]
+			if !ok {
+				return nil, fmt.Errorf("snapshot: period %q: missing sub-period %q", period, key)
+			}
+			ng.Posts.ByPeriod[period].SubPeriods[key] = sub
+		}
+	}
+	if ng.Posts.Quarantine, err = postList(s.Quarantine); err != nil {
+		return nil, err
+	}
+	if s.Duplicates != nil {
+		ng.Posts.Duplicates = s.Duplicates
+	}
+	if s.Years != nil {
+		ng.Posts.Years = s.Years
+	}
+
+	if s.Index != nil {
+		if len(s.Documents) != s.Index.Len() {
+			return nil, fmt.Errorf("snapshot: %d posts for %d documents", len(s.Documents), s.Index.Len())
+		}
+		ng.Corpus.Index = s.Index
+	}
+	if ng.Corpus.Posts, err = postList(s.Documents); err != nil {
+		return nil, err
+	}
+	ng.linkThreads()
+
+	return ng, nil
+}
@@ -0,0 +1,254 @@
+package newsgroup
+
+import (
+	"github.com/mdhender/mbox/internal/query"
+	"github.com/mdhender/mbox/internal/stores"
+	"sort"
+	"strings"
+)
+
+// NewsGroup implements the stores.Store interface.
+// Every method holds the read lock while it copies from the archive.
+var _ stores.Store = (*NewsGroup)(nil)
+
+func (ng *NewsGroup) Post(shaId string) (*stores.Post, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	p, ok := ng.Posts.ByShaId[shaId]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	return ng.toStore(p)
+}
+
+func (ng *NewsGroup) PostById(id string) (*stores.Post, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	p, ok := ng.Posts.ById[id]
+	if !ok || p.Missing {
+		return nil, stores.ErrNotFound
+	}
+	return ng.toStore(p)
+}
+
+func (ng *NewsGroup) Attachment(shaId string, n int) (*stores.Attachment, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	p, ok := ng.Posts.ByShaId[shaId]
+	if !ok || n < 1 || n > len(p.Attachments) {
+		return nil, stores.ErrNotFound
+	}
+	a := p.Attachments[n-1]
+	data, err := ng.attachment(p, n)
+	if err != nil {
+		return nil, err
+	}
+	return &stores.Attachment{Name: a.Name, Type: a.Type, Size: a.Size, Data: data}, nil
+}
+
+func (ng *NewsGroup) Period(name string) (*stores.Period, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	b, ok := ng.Posts.ByPeriod[name]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	period := &stores.Period{Name: b.Period}
+	if i := strings.LastIndexByte(b.Period, '/'); i != -1 {
+		period.Parent = b.Period[:i]
+	}
+	for _, child := range b.SubPeriods {
+		period.Children = append(period.Children, &stores.Count{Name: child.Period, Count: len(dayPosts(child))})
+	}
+	sort.Slice(period.Children, func(i, j int) bool {
+		return period.Children[i].Name < period.Children[j].Name
+	})
+	// only days list their posts
+	if len(b.SubPeriods) == 0 {
+		period.Posts = summaries(dayPosts(b))
+	}
+	return period, nil
+}
+
+// dayPosts returns the posts in the days of a period, once each.
+// A new bucket is seeded with the post that created it, which is then
+// added to its day again, so only the days are counted.
+func dayPosts(b *Bucket) []*Post {
+	var posts []*Post
+	if len(b.SubPeriods) != 0 {
+		for _, child := range b.SubPeriods {
+			posts = append(posts, dayPosts(child)...)
+		}
+		return posts
+	}
+	seen := make(map[*Post]bool)
+	for _, p := range b.Posts {
+		if !seen[p] {
+			seen[p] = true
+			posts = append(posts, p)
+		}
+	}
+	return posts
+}
+
+func (ng *NewsGroup) Author(address string) ([]*stores.Summary, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	posts, ok := ng.Posts.BySender[address]
+	if !ok {
+		return nil, stores.ErrNotFound
+	}
+	return sortByDate(summaries(posts)), nil
+}
+
+func (ng *NewsGroup) Thread(shaId string) ([]*stores.Summary, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	p, ok := ng.Posts.ByShaId[shaId]
+	if !ok {
+		return nil, stores.ErrNotFound
+	} else if p.DuplicateOf != nil {
+		p = p.DuplicateOf
+	}
+	// walk the links in both directions
+	seen := map[*Post]bool{p: true}
+	queue, thread := []*Post{p}, []*Post{}
+	for len(queue) != 0 {
+		p, queue = queue[0], queue[1:]
+		if !p.Missing {
+			thread = append(thread, p)
+		}
+		for _, links := range []map[string]*Post{p.References, p.ReferencedBy} {
+			for _, xref := range links {
+				if xref != nil && !seen[xref] {
+					seen[xref] = true
+					queue = append(queue, xref)
+				}
+			}
+		}
+	}
+	return sortByDate(summaries(thread)), nil
+}
+
+func (ng *NewsGroup) Search(input string, offset, limit int) (*stores.SearchResults, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	page, hits, err := query.Search(input, ng.Corpus.StopWords, corpusIndex{ng}, offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, hit := range hits {
+		page.Hits = append(page.Hits, &stores.Hit{Summary: *ng.Corpus.Posts[hit.Doc].Summary(), Score: hit.Score})
+	}
+	return page, nil
+}
+
+func (ng *NewsGroup) Stats() (*stores.Stats, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	stats := &stores.Stats{
+		Posts:       ng.Posts.Count,
+		From:        ng.Posts.From,
+		Through:     ng.Posts.Through,
+		Quarantined: len(ng.Posts.Quarantine),
+		Duplicates:  make(map[string]int),
+	}
+	for year, count := range ng.Posts.Years {
+		stats.Years = append(stats.Years, &stores.Count{Name: year, Count: count})
+	}
+	sort.Slice(stats.Years, func(i, j int) bool {
+		return stats.Years[i].Name < stats.Years[j].Name
+	})
+	for kind, count := range ng.Posts.Duplicates {
+		stats.Duplicates[string(kind)] = count
+	}
+	return stats, nil
+}
+
+func (ng *NewsGroup) Quarantine() ([]*stores.Quarantined, error) {
+	ng.RLock()
+	defer ng.RUnlock()
+	var list []*stores.Quarantined
+	for _, p := range ng.Posts.Quarantine {
+		q := &stores.Quarantined{
+			LineNo:  p.LineNo,
+			Id:      p.Id,
+			From:    p.Sender,
+			Subject: p.Subject,
+		}
+		if p.Error != nil {
+			q.Errors = strings.Split(p.Error.Error(), "\n")
+		}
+		list = append(list, q)
+	}
+	return list, nil
+}
+
+// toStore copies the post and the summaries of the posts it links to.
+// The body is read from the archive if it isn't kept in memory.
+func (ng *NewsGroup) toStore(p *Post) (*stores.Post, error) {
+	body, err := ng.body(p)
+	if err != nil {
+		return nil, err
+	}
+	post := &stores.Post{
+		Summary: *p.Summary(),
+		Lines:   p.Lines,
+		Body:    body,
+	}
+	for _, a := range p.Attachments {
+		post.Attachments = append(post.Attachments, &stores.Attachment{Name: a.Name, Type: a.Type, Size: a.Size})
+	}
+	for _, ref := range p.References {
+		if ref != nil {
+			post.References = append(post.References, ref.Summary())
+		}
+	}
+	sortByDate(post.References)
+	for _, ref := range p.ReferencedBy {
+		post.ReferencedBy = append(post.ReferencedBy, ref.Summary())
+	}
+	sortByDate(post.ReferencedBy)
+	post.Alternates = summaries(p.Alternates)
+	if p.DuplicateOf != nil {
+		post.DuplicateOf = p.DuplicateOf.Summary()
+	}
+	return post, nil
+}
+
+// Summary returns the summary of a post for the stores.
+func (p *Post) Summary() *stores.Summary {
+	return &stores.Summary{
+		Id:          p.Id,
+		ShaId:       p.ShaId,
+		LineNo:      p.LineNo,
+		From:        p.From.Display(),
+		FromAddress: p.From.Address,
+		Author:      p.From.Key(),
+		Subject:     p.Subject,
+		Date:        p.Date,
+		Spam:        p.Spam,
+		Struck:      p.Struck,
+		Missing:     p.Missing,
+		Duplicate:   string(p.Duplicate),
+	}
+}
+
+func summaries(posts []*Post) []*stores.Summary {
+	var list []*stores.Summary
+	for _, p := range posts {
+		list = append(list, p.Summary())
+	}
+	return list
+}
+
+// sortByDate sorts the summaries oldest first, using the line number to break ties.
+func sortByDate(list []*stores.Summary) []*stores.Summary {
+	sort.SliceStable(list, func(i, j int) bool {
+		if !list[i].Date.Equal(list[j].Date) {
+			return list[i].Date.Before(list[j].Date)
+		}
+		return list[i].LineNo < list[j].LineNo
+	})
+	return list
+}
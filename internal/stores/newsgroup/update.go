@@ -0,0 +1,203 @@
+package newsgroup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mdhender/mbox/internal/chunk"
+	"io"
+	"os"
+	"time"
+)
+
+// Source is the archive that the newsgroup was loaded from.
+// For an mbox file, it records how much of the file has been loaded
+// so that messages appended to the file can be added later.
+type Source struct {
+	Path   string       // path of the mbox file or directory
+	Format chunk.Format // format of the mbox file, nil for a directory
+	Offset int64        // number of bytes loaded from the file
+	Line   int          // number of lines loaded from the file
+	// Compressed is true if the file is compressed, so messages can't be
+	// read from it by offset
+	Compressed bool
+	// ModTime is the modification time of the archive when it was last read
+	ModTime time.Time
+	// Tail is a hash of the bytes just before Offset, used to check that
+	// the file has only been appended to since it was last read
+	Tail string
+	// Settings is a hash of the settings the posts were parsed with
+	Settings string
+	// Pending is the size of the file when Update last held back the
+	// message at the end of it, or 0 if it didn't
+	Pending int64
+}
+
+// tailSize is the number of bytes before the offset that are hashed.
+const tailSize = 4096
+
+// Modified reports whether the archive has been modified since it was last read.
+func (s Source) Modified() (bool, error) {
+	sb, err := os.Stat(s.Path)
+	if err != nil {
+		return false, err
+	}
+	return !sb.ModTime().Equal(s.ModTime), nil
+}
+
+// stamp records the modification time of the archive.
+// It should be called just before the archive is read.
+func (s *Source) stamp() error {
+	sb, err := os.Stat(s.Path)
+	if err != nil {
+		return err
+	}
+	s.ModTime = sb.ModTime()
+	return nil
+}
+
+// tail returns the hash of the bytes of the file just before offset.
+func tail(path string, offset int64) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	start := offset - tailSize
+	if start < 0 {
+		start = 0
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(fd, start, offset-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Load reads every message in the archive at path and remembers the
+// position of the last message so that Update can pick up from there.
+func (ng *NewsGroup) Load(path string, format chunk.Format, rules *chunk.Rules, workers int, createCorpus bool) (int, error) {
+	src, err := chunk.Open(path, format)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	ng.Source = Source{Path: path, Settings: ng.Settings(rules)}
+	if err := ng.Source.stamp(); err != nil {
+		return 0, err
+	}
+	if _, ok := src.(interface{ Format() chunk.Format }); ok {
+		if ng.Source.Compressed, err = chunk.Compressed(path); err != nil {
+			return 0, err
+		}
+	}
+	n, err := ng.Ingest(chunk.WithRules(src, rules), workers, createCorpus)
+	if err != nil {
+		return n, err
+	}
+	if mbox, ok := src.(interface{ Format() chunk.Format }); ok {
+		ng.Source.Format = mbox.Format()
+		if ng.Source.Tail, err = tail(path, ng.Source.Offset); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Update adds the messages appended to the archive since it was loaded.
+// The periods, sender lists, corpus, and links are updated in place,
+// and a post that was previously missing replaces its placeholder.
+//
+// The newsgroup is locked while the new messages are added, so readers
+// never see posts that haven't been linked. Update must not be called
+// from more than one goroutine at a time.
+//
+// The message at the end of the file may still be being written, so it
+// is held back until a later call finds that the file hasn't grown.
+//
+// Only uncompressed mbox files can be updated. It returns an error if
+// the archive is a directory, is compressed, or has been changed other
+// than by appending to it. The archive must be loaded again in those cases.
+func (ng *NewsGroup) Update(rules *chunk.Rules, workers int, createCorpus bool) (int, error) {
+	ng.RLock()
+	source := ng.Source
+	ng.RUnlock()
+	if source.Format == nil {
+		return 0, fmt.Errorf("%s: only mbox files can be updated", source.Path)
+	}
+	sb, err := os.Stat(source.Path)
+	if err != nil {
+		return 0, err
+	} else if sb.Size() < source.Offset {
+		return 0, fmt.Errorf("%s: archive is smaller than when it was loaded", source.Path)
+	} else if hash, err := tail(source.Path, source.Offset); err != nil {
+		return 0, err
+	} else if hash != source.Tail {
+		return 0, fmt.Errorf("%s: archive has been rewritten since it was loaded", source.Path)
+	} else if sb.Size() == source.Offset {
+		ng.Lock()
+		ng.Source.ModTime = sb.ModTime()
+		ng.Unlock()
+		return 0, nil
+	}
+
+	src, err := chunk.OpenAt(source.Path, source.Format, source.Offset, source.Line)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	held := &holdLast{Source: src, size: sb.Size(), hold: source.Pending != sb.Size()}
+
+	ng.Lock()
+	defer ng.Unlock()
+	ng.Source.ModTime = sb.ModTime()
+	n, readErr := ng.Ingest(chunk.WithRules(held, rules), workers, createCorpus)
+	if ng.Source.Pending = 0; held.held {
+		ng.Source.Pending = sb.Size()
+	}
+	if n != 0 {
+		ng.LinkPosts()
+	}
+	if ng.Source.Offset != source.Offset {
+		if ng.Source.Tail, err = tail(source.Path, ng.Source.Offset); err != nil {
+			return n, err
+		}
+	}
+	return n, readErr
+}
+
+// holdLast is a source that holds back the message at the end of the
+// file if it may not have been completely written. A message that runs
+// past the size the file had when it was checked is always held back.
+type holdLast struct {
+	chunk.Source
+	size int64        // size of the file when it was checked
+	hold bool         // true if the file may still be growing
+	next *chunk.Chunk // the chunk read ahead of the caller
+	held bool         // true if the last chunk was held back
+}
+
+func (h *holdLast) Next() (*chunk.Chunk, error) {
+	if h.next == nil {
+		ch, err := h.Source.Next()
+		if err != nil {
+			return nil, err
+		}
+		h.next = ch
+	}
+	ch := h.next
+	next, err := h.Source.Next()
+	if err == io.EOF {
+		h.next = nil
+		if h.hold || ch.Offset+ch.Length > h.size {
+			h.held = true
+			return nil, io.EOF
+		}
+		return ch, nil
+	} else if err != nil {
+		return nil, err
+	}
+	h.next = next
+	return ch, nil
+}
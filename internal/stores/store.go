@@ -0,0 +1,145 @@
+// Package stores defines the interface between the application and the
+// backends that hold the archive.
+//
+// Backends return their own copies of the types in this package, so
+// callers may keep them without worrying about the archive being
+// updated or reloaded underneath them.
+package stores
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned when a post, period, or author isn't in the archive.
+var ErrNotFound = errors.New("not found")
+
+// Store is an archive of posts.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Post returns the post with the given ShaId.
+	Post(shaId string) (*Post, error)
+	// PostById returns the canonical post with the given Message-ID.
+	PostById(id string) (*Post, error)
+	// Attachment returns the n-th attachment of a post, counting from 1.
+	Attachment(shaId string, n int) (*Attachment, error)
+	// Period returns a year ("2006"), month ("2006/01"), or day ("2006/01/02").
+	// Only days list their posts.
+	Period(name string) (*Period, error)
+	// Author returns the posts from a normalized address, oldest first.
+	Author(address string) ([]*Summary, error)
+	// Thread returns every post linked to the post with the given ShaId,
+	// by references in either direction, oldest first.
+	Thread(shaId string) ([]*Summary, error)
+	// Search returns limit posts, starting at offset, from the posts that
+	// match the query, best match first. See package query for the syntax;
+	// a query that can't be parsed returns a *query.SyntaxError.
+	// If limit is zero, it returns every post from offset on.
+	Search(query string, offset, limit int) (*SearchResults, error)
+	// Stats returns the counts for the archive.
+	Stats() (*Stats, error)
+	// Quarantine returns the posts that had errors when they were parsed.
+	Quarantine() ([]*Quarantined, error)
+}
+
+// Post is a single post with its links to other posts.
+type Post struct {
+	Summary
+	Lines        int
+	Body         string
+	Attachments  []*Attachment // Data is not set; use Store.Attachment to fetch it
+	References   []*Summary    // posts this post references, oldest first
+	ReferencedBy []*Summary    // posts referring to this post, oldest first
+	Alternates   []*Summary    // other copies of this post
+	DuplicateOf  *Summary      // the canonical post if this is a duplicate copy
+}
+
+// Summary is enough of a post to list it or link to it.
+type Summary struct {
+	Id          string
+	ShaId       string
+	LineNo      int
+	From        string // display name of the sender
+	FromAddress string // normalized address of the sender
+	Author      string // key for the posts from the sender, usually FromAddress
+	Subject     string
+	Date        time.Time
+	Spam        bool
+	Struck      bool
+	Missing     bool   // true if the post is referenced but isn't in the archive
+	Duplicate   string // how a duplicate copy differs from the canonical post
+}
+
+// Attachment is a MIME part that isn't shown as the body of a post.
+type Attachment struct {
+	Name string
+	Type string
+	Size int
+	Data []byte
+}
+
+// Period is a year, month, or day of the archive.
+type Period struct {
+	Name     string
+	Parent   string   // name of the parent period, empty for a year
+	Children []*Count // sub-periods and the number of posts in each
+	Posts    []*Summary
+}
+
+// Count is the number of posts in a period.
+type Count struct {
+	Name  string
+	Count int
+}
+
+// SearchResults is a page of the posts that matched a search.
+type SearchResults struct {
+	Total int      // number of posts that matched, not just those on the page
+	Hits  []*Hit   // best match first
+	Words []string // stems of the words the posts were ranked on, for highlighting
+	// Suggestion is the query with misspelled words corrected, set if
+	// nothing matched and the corrected query finds something.
+	Suggestion string
+	Facets     *Facets // counts of all the posts that matched, not just those on the page
+}
+
+// Facets are the number of posts that matched a search in each year,
+// month, sender, and thread.
+type Facets struct {
+	Years   []*Facet // sorted by year
+	Months  []*Facet // the busiest months, sorted by month
+	Authors []*Facet // the busiest senders, most posts first
+	Threads []*Facet // the busiest threads, most posts first
+}
+
+// Facet is a group of the posts that matched a search.
+type Facet struct {
+	Query string // query field that narrows a search to the group, like "year:1995"
+	Label string
+	Count int
+}
+
+// Hit is a post that matched a search.
+type Hit struct {
+	Summary
+	Score float64 // higher is a better match
+}
+
+// Stats are the counts for the whole archive.
+type Stats struct {
+	Posts       int // number of posts, not counting duplicates and missing posts
+	From        time.Time
+	Through     time.Time
+	Years       []*Count // sorted by year
+	Quarantined int
+	Duplicates  map[string]int // number of duplicate copies of each kind
+}
+
+// Quarantined is a post that had errors when it was parsed.
+type Quarantined struct {
+	LineNo  int
+	Id      string
+	From    string
+	Subject string
+	Errors  []string
+}
@@ -0,0 +1,56 @@
+package stores
+
+// Walk calls fn for every post in the store, including duplicate copies.
+// Posts are found by walking the years, months, and days, so they are
+// visited in date order, and a duplicate copy is visited right after
+// its canonical post. Each post is visited once.
+func Walk(src Store, fn func(*Post) error) error {
+	stats, err := src.Stats()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	var visit func(shaId string) error
+	visit = func(shaId string) error {
+		if seen[shaId] {
+			return nil
+		}
+		seen[shaId] = true
+		post, err := src.Post(shaId)
+		if err != nil {
+			return err
+		} else if err := fn(post); err != nil {
+			return err
+		}
+		for _, alternate := range post.Alternates {
+			if err := visit(alternate.ShaId); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var walk func(name string) error
+	walk = func(name string) error {
+		p, err := src.Period(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range p.Children {
+			if err := walk(child.Name); err != nil {
+				return err
+			}
+		}
+		for _, summary := range p.Posts {
+			if err := visit(summary.ShaId); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, year := range stats.Years {
+		if err := walk(year.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -5,77 +5,155 @@ import (
 	"flag"
 	"github.com/mdhender/mbox/internal/app"
 	"github.com/mdhender/mbox/internal/chunk"
+	"github.com/mdhender/mbox/internal/dates"
+	"github.com/mdhender/mbox/internal/lru"
+	"github.com/mdhender/mbox/internal/stores"
+	"github.com/mdhender/mbox/internal/stores/bolt"
+	"github.com/mdhender/mbox/internal/stores/memory"
 	"github.com/mdhender/mbox/internal/stores/newsgroup"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
 	"time"
 )
 
 func main() {
-	doCorpus, doSpam, showHeaders, flagSpam, flagStruck := false, false, false, false, false
-	flag.BoolVar(&doCorpus, "corpus", doCorpus, "create corpus")
+	doCorpus, doSpam, showHeaders, flagSpam, flagStruck, showErrors := false, false, false, false, false, false
+	doAdmin := false
+	flag.BoolVar(&doCorpus, "corpus", doCorpus, "report the size of the search index")
 	flag.BoolVar(&doSpam, "spam", doCorpus, "allow spam reports")
+	flag.BoolVar(&doAdmin, "admin", doAdmin, "serve the /admin pages, which let anyone reload the archive")
 	flag.BoolVar(&flagSpam, "flag-spam", flagSpam, "show suspected spam headers")
 	flag.BoolVar(&flagStruck, "flag-struck", flagStruck, "show suspected struct headers")
 	flag.BoolVar(&showHeaders, "show-headers", showHeaders, "show headers")
+	flag.BoolVar(&showErrors, "errors", showErrors, "show quarantined posts and quit")
+	input, mboxFormat := "rec.games.pbm.mbox", "auto"
+	flag.StringVar(&input, "input", input, "mbox file (optionally gzip or bzip2 compressed) or Maildir/MH directory to load")
+	flag.StringVar(&mboxFormat, "format", mboxFormat, "mbox format (auto, takeout, mboxo, mboxrd, mboxcl, mboxcl2)")
+	workers := runtime.NumCPU()
+	flag.IntVar(&workers, "workers", workers, "number of goroutines parsing messages")
+	var updateEvery time.Duration
+	flag.DurationVar(&updateEvery, "update", updateEvery, "how often to check the mbox file for new messages (0 to never check)")
+	snapshotFile := ""
+	flag.StringVar(&snapshotFile, "snapshot", snapshotFile, "file to save the parsed archive in for a faster start (empty for none)")
+	backend := "newsgroup"
+	flag.StringVar(&backend, "store", backend, "backend that serves the archive (newsgroup, memory, bolt)")
+	database, cacheSize := "mbox.db", 10_000
+	flag.StringVar(&database, "db", database, "database file for the bolt store")
+	flag.IntVar(&cacheSize, "cache", cacheSize, "number of posts the bolt store keeps in memory")
+	bodies := 1_000
+	flag.IntVar(&bodies, "bodies", bodies, "number of post bodies to cache when they are read from the mbox file as needed (0 keeps every body in memory)")
+	rulesFile := "../rules/rec.games.pbm.json"
+	flag.StringVar(&rulesFile, "rules", rulesFile, "header rewrite rules for the archive (empty for none)")
 	flag.Parse()
 
+	format, err := chunk.FormatByName(mboxFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch backend {
+	case "newsgroup", "memory", "bolt":
+	default:
+		log.Fatalf("unknown store %q: want newsgroup, memory, or bolt", backend)
+	}
+	var rules *chunk.Rules
+	if rulesFile != "" {
+		rules, err = chunk.LoadRules(rulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("[mbox] loaded %d rules from %s\n", len(rules.Rules), rulesFile)
+	}
+
 	started := time.Now()
 	defer func(started time.Time) {
 		log.Printf("[mbox] completed in %v\n", time.Now().Sub(started))
 	}(started)
 
-	// chunks splits and cleans up the input
-	chunks, err := chunk.Chunks("rec.games.pbm.mbox")
-	if err != nil {
-		log.Fatal(err)
+	// the bolt store is built from the archive without loading the newsgroup,
+	// and doesn't need the archive at all if its database is current
+	var store stores.Store
+	if backend == "bolt" && !(showErrors || flagSpam || flagStruck) {
+		if db := openDatabase(database, input, rules, cacheSize); db != nil {
+			log.Printf("[bolt] opened %s in %v\n", database, time.Now().Sub(started))
+			store = db
+		} else if store, err = buildDatabase(database, input, format, rules, workers, cacheSize); err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	ng := newsgroup.New()
-	for _, ch := range chunks {
-		post, err := ng.Parse(ch, doCorpus)
+	// start from the snapshot if it is current
+	var ng *newsgroup.NewsGroup
+	if store == nil && snapshotFile != "" && !(showErrors || flagSpam || flagStruck) {
+		ng = loadSnapshot(snapshotFile, input, rules, workers, bodies)
+		if ng != nil {
+			log.Printf("[snapshot] loaded %d posts in %v\n", len(ng.Posts.ById), time.Now().Sub(started))
+		}
+	}
+	if store == nil && ng == nil {
+		// the source splits and cleans up the input one message at a time
+		ng, err = loadNewsGroup(input, format, rules, workers, bodies)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if post.Words != nil {
-			ng.Corpus.Documents[post.Id] = post.Words
+		log.Printf("[mbox] completed parse in %v\n", time.Now().Sub(started))
+		for _, line := range rules.Report() {
+			log.Printf("[rules] %s\n", line)
+		}
+
+		// optional: show the quarantine report and quit
+		if showErrors {
+			for _, post := range ng.Posts.Quarantine {
+				log.Printf("[errors] line %d: id %q: subject %q\n", post.LineNo, post.Id, post.Subject)
+				for _, line := range strings.Split(post.Error.Error(), "\n") {
+					log.Printf("[errors]     %s\n", line)
+				}
+			}
+			os.Exit(2)
 		}
-	}
-	log.Printf("[mbox] completed parse in %v\n", time.Now().Sub(started))
 
-	// link posts (both forwards and backwards)
-	ng.LinkPosts()
-	log.Printf("[mbox] completed links in %v\n", time.Now().Sub(started))
+		// link posts (both forwards and backwards)
+		ng.LinkPosts()
+		log.Printf("[mbox] completed links in %v\n", time.Now().Sub(started))
 
-	// optional: show lists of suspect posts and quit
-	if flagSpam || flagStruck {
-		if flagSpam {
-			ng.FlagSpam()
+		// optional: show lists of suspect posts and quit
+		if flagSpam || flagStruck {
+			if flagSpam {
+				ng.FlagSpam()
+			}
+			if flagStruck {
+				ng.FlagStruck()
+			}
+			log.Printf("[mbox] completed flags in %v\n", time.Now().Sub(started))
+			os.Exit(2)
 		}
-		if flagStruck {
-			ng.FlagStruck()
+
+		if snapshotFile != "" {
+			if err := ng.WriteSnapshot(snapshotFile); err != nil {
+				log.Printf("[snapshot] %v\n", err)
+			} else {
+				log.Printf("[snapshot] saved to %s\n", snapshotFile)
+			}
 		}
-		log.Printf("[mbox] completed flags in %v\n", time.Now().Sub(started))
-		os.Exit(2)
 	}
 
 	//for _, post := range ng.SearchPosts("compliment blessed") { //  firestorm Morghoul perceval dean
 	//	log.Printf("[search] post http://localhost:8080/posts/%s\n", post.ShaId)
 	//}
 
-	// we're done with the chunks
-	chunks = nil
-
-	if doCorpus {
+	if doCorpus && ng != nil {
 		index := make(map[string][]int)
-		for k, v := range ng.Corpus.Index {
-			docs := make([]int, len(v))
-			for _, post := range v {
-				docs = append(docs, post.LineNo)
+		for _, word := range ng.Corpus.Index.Words() {
+			var docs []int
+			for _, doc := range ng.Corpus.Index.Lookup(word).Docs() {
+				docs = append(docs, ng.Corpus.Posts[doc].LineNo)
 			}
-			index[k] = docs
+			index[word] = docs
 		}
 		data, err := json.Marshal(index)
 		if err != nil {
@@ -90,11 +168,192 @@ func main() {
 	//	log.Printf("post %q\n%q\n", post.Id, post.Body)
 	//}
 
-	a, err := app.New(ng, doSpam)
+	if store == nil {
+		store, err = newStore(backend, ng)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	a, err := app.New(store, doSpam)
 	if err != nil {
 		log.Fatal(err)
 	}
+	a.Admin = doAdmin
+	a.Loader = func() (stores.Store, error) {
+		if backend == "bolt" {
+			return buildDatabase(database, input, format, rules, workers, cacheSize)
+		}
+		ng, err := loadNewsGroup(input, format, rules, workers, bodies)
+		if err != nil {
+			return nil, err
+		}
+		ng.LinkPosts()
+		if snapshotFile != "" {
+			if err := ng.WriteSnapshot(snapshotFile); err != nil {
+				log.Printf("[snapshot] %v\n", err)
+			}
+		}
+		return newStore(backend, ng)
+	}
+
+	// reload the archive on SIGHUP
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := a.Reload(); err != nil {
+				log.Printf("[app] %v\n", err)
+			}
+		}
+	}()
+
+	// optional: add messages as they are appended to the mbox file
+	if updateEvery > 0 {
+		go func() {
+			for range time.Tick(updateEvery) {
+				store, release := a.Store()
+				ng, ok := store.(*newsgroup.NewsGroup)
+				if !ok {
+					release()
+					log.Printf("[mbox] update: the %s store can't be updated\n", backend)
+					return
+				}
+				if count, err := ng.Update(rules, workers, true); err != nil {
+					log.Printf("[mbox] update: %v\n", err)
+				} else if count != 0 {
+					log.Printf("[mbox] update: added %d messages\n", count)
+				}
+				release()
+			}
+		}()
+	}
 
 	log.Printf("[app] serving on %s\n", net.JoinHostPort(a.Host, a.Port))
 	log.Fatalln(http.ListenAndServe(net.JoinHostPort(a.Host, a.Port), a.Router))
 }
+
+// loadNewsGroup parses the archive and logs a summary of the results.
+// The posts are indexed for searching but not linked. If bodies isn't zero, the bodies are read
+// from the archive when needed and that many are cached.
+func loadNewsGroup(input string, format chunk.Format, rules *chunk.Rules, workers, bodies int) (*newsgroup.NewsGroup, error) {
+	ng := newsgroup.New()
+	if bodies != 0 {
+		ng.Bodies = lru.New[string, string](bodies)
+	}
+	count, err := ng.Load(input, format, rules, workers, true)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[mbox] parsed %d messages with %d workers\n", count, workers)
+	log.Printf("[mbox] quarantined %d posts with errors\n", len(ng.Posts.Quarantine))
+	for kind, count := range ng.Posts.Duplicates {
+		log.Printf("[mbox] %6d duplicate ids: %s\n", count, kind)
+	}
+	strategies := make(map[dates.Strategy]int)
+	for _, post := range ng.Posts.ById {
+		strategies[post.DateSource]++
+	}
+	for strategy, count := range strategies {
+		log.Printf("[mbox] %6d dates from %s\n", count, strategy)
+	}
+	return ng, nil
+}
+
+// loadSnapshot returns the newsgroup saved in the snapshot, or nil if the
+// snapshot can't be used. A snapshot is stale if the archive has been
+// modified since it was written. If messages have only been appended to
+// the archive, they are added and the snapshot is saved again. Otherwise,
+// the archive must be parsed again.
+func loadSnapshot(path, input string, rules *chunk.Rules, workers, bodies int) *newsgroup.NewsGroup {
+	ng, err := newsgroup.ReadSnapshot(path)
+	if err != nil {
+		log.Printf("[snapshot] %v\n", err)
+		return nil
+	} else if ng.Source.Path != input {
+		log.Printf("[snapshot] %s: snapshot is for %q\n", path, ng.Source.Path)
+		return nil
+	} else if ng.Corpus.Index.Len() == 0 && len(ng.Posts.ById) != 0 {
+		log.Printf("[snapshot] %s: snapshot has no corpus\n", path)
+		return nil
+	} else if ng.Source.Settings != ng.Settings(rules) {
+		log.Printf("[snapshot] %s: stale: the spam or struck lists or the rules have changed\n", path)
+		return nil
+	}
+	if bodies != 0 {
+		ng.Bodies = lru.New[string, string](bodies)
+	}
+	if modified, err := ng.Source.Modified(); err != nil {
+		log.Printf("[snapshot] %v\n", err)
+		return nil
+	} else if modified {
+		count, err := ng.Update(rules, workers, true)
+		if err != nil {
+			log.Printf("[snapshot] %s: stale: %v\n", path, err)
+			return nil
+		}
+		log.Printf("[snapshot] added %d messages appended to %s\n", count, input)
+		if err := ng.WriteSnapshot(path); err != nil {
+			log.Printf("[snapshot] %v\n", err)
+		}
+	}
+	return ng
+}
+
+// openDatabase opens the bolt database, or returns nil if it is missing,
+// older than the archive, or was built with other spam or struck lists
+// or rules.
+func openDatabase(path, input string, rules *chunk.Rules, cacheSize int) stores.Store {
+	sdb, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[bolt] %v\n", err)
+		}
+		return nil
+	}
+	if sin, err := os.Stat(input); err != nil {
+		log.Printf("[bolt] %v\n", err)
+		return nil
+	} else if sin.ModTime().After(sdb.ModTime()) {
+		log.Printf("[bolt] %s: stale: %s has been modified\n", path, input)
+		return nil
+	}
+	db, err := bolt.Open(path, cacheSize)
+	if err != nil {
+		log.Printf("[bolt] %v\n", err)
+		return nil
+	} else if db.Settings() != newsgroup.New().Settings(rules) {
+		log.Printf("[bolt] %s: stale: the spam or struck lists or the rules have changed\n", path)
+		db.Close()
+		return nil
+	}
+	return db
+}
+
+// buildDatabase builds the bolt database from the archive and opens it.
+func buildDatabase(path, input string, format chunk.Format, rules *chunk.Rules, workers, cacheSize int) (stores.Store, error) {
+	started := time.Now()
+	count, err := bolt.Build(path, input, format, rules, workers)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[bolt] built %s from %d messages in %v\n", path, count, time.Now().Sub(started))
+	for _, line := range rules.Report() {
+		log.Printf("[rules] %s\n", line)
+	}
+	return bolt.Open(path, cacheSize)
+}
+
+// newStore returns the backend that serves the newsgroup.
+// The memory store is copied from it.
+func newStore(backend string, ng *newsgroup.NewsGroup) (stores.Store, error) {
+	if backend == "memory" {
+		started := time.Now()
+		store, err := memory.Copy(ng, ng.Corpus.StopWords)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[store] copied archive to memory in %v\n", time.Now().Sub(started))
+		return store, nil
+	}
+	return ng, nil
+}